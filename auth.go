@@ -0,0 +1,441 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	s "strings"
+	"sync"
+	"time"
+)
+
+// Optional authentication for the web app, enabled by the auth section of
+// config.yml:
+//
+//   auth:
+//     passphrase: "correct horse battery staple"
+//     tokens:
+//       phone: "a long random string"
+//       scanner-script: "another long random string"
+//
+// Browsers log in with the passphrase and get a session cookie. Scripts and
+// devices send one of the tokens in an "Authorization: Bearer <token>" or
+// "X-Api-Token" header. Form POSTs with the session cookie must come from the
+// same origin or carry the CSRF token of the session.
+
+type authConf struct {
+	Passphrase string `yaml:"passphrase"`
+	// device name: token
+	Tokens map[string]string `yaml:"tokens"`
+	// Keeps sessions valid across restarts, a random one is used otherwise
+	SessionSecret string `yaml:"session_secret"`
+	SessionDays   int    `yaml:"session_days"`
+}
+
+func (a authConf) enabled() bool {
+	return len(a.Passphrase) > 0 || len(a.Tokens) > 0
+}
+
+const sessionCookieName = "b2b_session"
+
+type authenticator struct {
+	conf   authConf
+	secret []byte
+
+	// listening on a Unix socket, the reverse proxy tells the client address
+	behindProxy bool
+
+	mu sync.Mutex
+	// wrong passphrases by client address
+	attempts map[string]*loginAttempts
+	// nonces of the sessions logged out, until the cookie would expire
+	revoked map[string]time.Time
+}
+
+// After a wrong passphrase the client waits before it can try again, twice as
+// long after each one, up to maxLoginDelay. Clients which stopped trying are
+// forgotten after loginForget.
+const maxLoginDelay = 5 * time.Minute
+const loginForget = time.Hour
+
+type loginAttempts struct {
+	failures int
+	// no attempt before this
+	next time.Time
+}
+
+// nil when auth is not enabled
+var authn *authenticator
+
+func newAuthenticator(c authConf) *authenticator {
+	secret := []byte(c.SessionSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if c.SessionDays <= 0 {
+		c.SessionDays = 30
+	}
+	return &authenticator{
+		conf:     c,
+		secret:   secret,
+		attempts: make(map[string]*loginAttempts),
+		revoked:  make(map[string]time.Time),
+	}
+}
+
+// loginClient is the address the login attempts are counted by. Behind the
+// reverse proxy every request comes from the socket, the proxy's X-Real-IP or
+// the address it added last to X-Forwarded-For is taken instead. Only the
+// proxy can reach the socket, so the headers can be trusted.
+func (a *authenticator) loginClient(r *http.Request) string {
+	if a.behindProxy {
+		if ip := s.TrimSpace(r.Header.Get("X-Real-IP")); len(ip) > 0 {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+			hops := s.Split(fwd, ",")
+			if ip := s.TrimSpace(hops[len(hops)-1]); len(ip) > 0 {
+				return ip
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// loginWait is how long the client has to wait before trying again.
+func (a *authenticator) loginWait(client string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if at, ok := a.attempts[client]; ok {
+		if wait := time.Until(at.next); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func (a *authenticator) loginFailed(client string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for c, at := range a.attempts {
+		if now.Sub(at.next) > loginForget {
+			delete(a.attempts, c)
+		}
+	}
+
+	at, ok := a.attempts[client]
+	if !ok {
+		at = &loginAttempts{}
+		a.attempts[client] = at
+	}
+	at.failures++
+	delay := maxLoginDelay
+	if at.failures < 10 {
+		if d := time.Second << uint(at.failures-1); d < maxLoginDelay {
+			delay = d
+		}
+	}
+	at.next = now.Add(delay)
+}
+
+func (a *authenticator) loginSucceeded(client string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.attempts, client)
+}
+
+func (a *authenticator) sign(text string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func secureEqual(x string, y string) bool {
+	return subtle.ConstantTimeCompare([]byte(x), []byte(y)) == 1
+}
+
+// newSession returns a cookie value of the form nonce.expiry.signature
+func (a *authenticator) newSession() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Duration(a.conf.SessionDays) * 24 * time.Hour).Unix()
+	payload := fmt.Sprintf("%s.%d", hex.EncodeToString(b), expiry)
+	return payload + "." + a.sign(payload)
+}
+
+// session returns the nonce of a valid session cookie.
+func (a *authenticator) session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+
+	parts := s.Split(c.Value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	if !secureEqual(a.sign(parts[0]+"."+parts[1]), parts[2]) {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+
+	a.mu.Lock()
+	_, revoked := a.revoked[parts[0]]
+	a.mu.Unlock()
+	if revoked {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// revoke ends the session of the nonce before its cookie expires.
+func (a *authenticator) revoke(nonce string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for n, until := range a.revoked {
+		if now.After(until) {
+			delete(a.revoked, n)
+		}
+	}
+
+	// no session cookie lives longer
+	a.revoked[nonce] = now.Add(time.Duration(a.conf.SessionDays) * 24 * time.Hour)
+}
+
+func (a *authenticator) csrfToken(nonce string) string {
+	return a.sign("csrf:" + nonce)
+}
+
+// validToken checks the device tokens, the name of the device is returned.
+func (a *authenticator) validToken(r *http.Request) (string, bool) {
+	token := r.Header.Get("X-Api-Token")
+	if auth := r.Header.Get("Authorization"); s.HasPrefix(auth, "Bearer ") {
+		token = s.TrimPrefix(auth, "Bearer ")
+	}
+	if len(token) == 0 {
+		return "", false
+	}
+
+	found := ""
+	for device, t := range a.conf.Tokens {
+		if len(t) > 0 && secureEqual(t, token) {
+			found = device
+		}
+	}
+	return found, len(found) > 0
+}
+
+// sameOrigin checks the Origin header, or the Referer when there is no
+// Origin, against the host the request was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+	if len(origin) == 0 {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (a *authenticator) checkCSRF(r *http.Request, nonce string) bool {
+	if isSafeMethod(r.Method) || sameOrigin(r) {
+		return true
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if len(token) == 0 {
+		token = r.FormValue("csrf_token")
+	}
+	return len(token) > 0 && secureEqual(token, a.csrfToken(nonce))
+}
+
+func sendAuthError(w http.ResponseWriter, status int, msg string) {
+	codes := map[int]string{
+		http.StatusUnauthorized: "unauthorized",
+		http.StatusForbidden:    "forbidden",
+		http.StatusNotFound:     "not_found",
+	}
+	data := make(map[string]interface{})
+	data["error"] = apiError{Code: codes[status], Message: msg}
+	data["flash"] = msg
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+// ServeHTTP is the negroni middleware.
+func (a *authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	switch r.URL.Path {
+	case "/login":
+		a.loginHandler(w, r)
+		return
+	case "/logout":
+		a.logoutHandler(w, r)
+		return
+	}
+
+	// the login page's own assets
+	if r.Method == "GET" && loginAssets[r.URL.Path] {
+		next(w, r)
+		return
+	}
+
+	if _, ok := a.validToken(r); ok {
+		next(w, r)
+		return
+	}
+
+	if nonce, ok := a.session(r); ok {
+		if !a.checkCSRF(r, nonce) {
+			sendAuthError(w, http.StatusForbidden, "Invalid CSRF token")
+			return
+		}
+		next(w, r)
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	sendAuthError(w, http.StatusUnauthorized, "Login required")
+}
+
+// Served without a session, the rest of /public needs one.
+var loginAssets = map[string]bool{
+	"/css/site.css": true,
+	"/favicon.ico":  true,
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta content="width=device-width, initial-scale=1" name="viewport">
+    <link href="css/site.css" rel="stylesheet" type="text/css">
+    <title>Bills to Beans</title>
+  </head>
+  <body>
+    <div class="container">
+      <form method="POST" action="/login" style="max-width: 20em; margin: 4em auto;">
+        {{ if .message }}<div class="alert alert-warning">{{ .message }}</div>{{ end }}
+        <div class="form-group">
+          <label for="passphrase">Passphrase</label>
+          <input class="form-control" type="password" id="passphrase" name="passphrase" autofocus>
+        </div>
+        <button class="btn btn-primary" type="submit">Log in</button>
+      </form>
+    </div>
+  </body>
+</html>
+`))
+
+func (a *authenticator) loginHandler(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]string)
+
+	if len(a.conf.Passphrase) == 0 {
+		sendAuthError(w, http.StatusNotFound, "Login with a passphrase is not enabled")
+		return
+	}
+
+	if r.Method == "POST" {
+		// a login form posted from another site could log the browser into
+		// the attacker's session
+		if !sameOrigin(r) {
+			sendAuthError(w, http.StatusForbidden, "Invalid origin")
+			return
+		}
+
+		client := a.loginClient(r)
+		if wait := a.loginWait(client); wait > 0 {
+			seconds := int(wait/time.Second) + 1
+			w.Header().Set("Content-type", "text/html; charset=utf-8")
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.WriteHeader(http.StatusTooManyRequests)
+			data["message"] = fmt.Sprintf("Too many wrong passphrases, try again in %d seconds", seconds)
+			loginTemplate.Execute(w, data)
+			return
+		}
+
+		if secureEqual(r.PostFormValue("passphrase"), a.conf.Passphrase) {
+			a.loginSucceeded(client)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    a.newSession(),
+				Path:     "/",
+				MaxAge:   a.conf.SessionDays * 24 * 60 * 60,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		// slow down guessing
+		a.loginFailed(client)
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		data["message"] = "Wrong passphrase"
+		loginTemplate.Execute(w, data)
+		return
+	}
+
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	loginTemplate.Execute(w, data)
+}
+
+func (a *authenticator) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !sameOrigin(r) {
+		sendAuthError(w, http.StatusForbidden, "Invalid origin")
+		return
+	}
+	// a copy of the cookie is no use after logging out
+	if nonce, ok := a.session(r); ok {
+		a.revoke(nonce)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
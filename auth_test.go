@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	s "strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	a := newAuthenticator(authConf{
+		Passphrase: "secret words",
+		Tokens:     map[string]string{"phone": "phone-token"},
+	})
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r, ok)
+		return w
+	}
+
+	// no credentials
+	if w := serve(httptest.NewRequest("POST", "/save", nil)); w.Code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", w.Code)
+	}
+	if w := serve(httptest.NewRequest("GET", "/", nil)); w.Code != http.StatusSeeOther {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// device token
+	r := httptest.NewRequest("POST", "/save", nil)
+	r.Header.Set("Authorization", "Bearer phone-token")
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("hey: %d", w.Code)
+	}
+	r = httptest.NewRequest("POST", "/save", nil)
+	r.Header.Set("X-Api-Token", "wrong-token")
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// a login form posted from another site
+	form := url.Values{"passphrase": {"secret words"}}
+	r = httptest.NewRequest("POST", "http://example.com/login", s.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://evil.com")
+	if w := serve(r); w.Code != http.StatusForbidden {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// login
+	r = httptest.NewRequest("POST", "http://example.com/login", s.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://example.com")
+	w := serve(r)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+		t.Fatalf("hey: %d %v", w.Code, cookies)
+	}
+	session := cookies[0]
+
+	r = httptest.NewRequest("GET", "http://example.com/bills", nil)
+	r.AddCookie(session)
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "http://example.com/save", nil)
+	r.AddCookie(session)
+	r.Header.Set("Origin", "http://example.com")
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// cross site request with the session cookie
+	r = httptest.NewRequest("POST", "http://example.com/save", nil)
+	r.AddCookie(session)
+	r.Header.Set("Origin", "http://evil.com")
+	if w := serve(r); w.Code != http.StatusForbidden {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// without an origin the CSRF token is needed
+	nonce, _ := a.session(r)
+	r = httptest.NewRequest("POST", "http://example.com/save", nil)
+	r.AddCookie(session)
+	r.Header.Set("X-CSRF-Token", a.csrfToken(nonce))
+	if w := serve(r); w.Code != http.StatusOK {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// tampered session
+	r = httptest.NewRequest("GET", "http://example.com/bills", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: s.Replace(session.Value, ".", "9.", 1)})
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	// logout, a kept copy of the cookie doesn't work afterwards
+	r = httptest.NewRequest("POST", "http://example.com/logout", nil)
+	r.AddCookie(session)
+	r.Header.Set("Origin", "http://example.com")
+	if w := serve(r); w.Code != http.StatusSeeOther {
+		t.Errorf("hey: %d", w.Code)
+	}
+	r = httptest.NewRequest("GET", "http://example.com/bills", nil)
+	r.AddCookie(session)
+	if w := serve(r); w.Code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", w.Code)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	a := newAuthenticator(authConf{Passphrase: "secret words"})
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	login := func(passphrase string, client string) int {
+		form := url.Values{"passphrase": {passphrase}}
+		r := httptest.NewRequest("POST", "http://example.com/login", s.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		r.RemoteAddr = client
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r, ok)
+		return w.Code
+	}
+
+	if code := login("guess", "192.0.2.1:1234"); code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", code)
+	}
+	// right away, even with the right passphrase and from another port
+	if code := login("secret words", "192.0.2.1:4321"); code != http.StatusTooManyRequests {
+		t.Errorf("hey: %d", code)
+	}
+	if code := login("secret words", "192.0.2.2:1234"); code != http.StatusSeeOther {
+		t.Errorf("hey: %d", code)
+	}
+
+	// behind the reverse proxy every client comes from the socket
+	a.behindProxy = true
+	viaProxy := func(passphrase string, forwardedFor string) int {
+		form := url.Values{"passphrase": {passphrase}}
+		r := httptest.NewRequest("POST", "http://example.com/login", s.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Origin", "http://example.com")
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		r.RemoteAddr = "@"
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r, ok)
+		return w.Code
+	}
+	if code := viaProxy("guess", "198.51.100.1"); code != http.StatusUnauthorized {
+		t.Errorf("hey: %d", code)
+	}
+	// the first address is sent by the client, only the proxy's counts
+	if code := viaProxy("secret words", "203.0.113.9, 198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("hey: %d", code)
+	}
+	if code := viaProxy("secret words", "198.51.100.2"); code != http.StatusSeeOther {
+		t.Errorf("hey: %d", code)
+	}
+	a.behindProxy = false
+
+	// the login page's stylesheet, but not the app
+	for path, expect := range map[string]int{"/css/site.css": http.StatusOK, "/js/app.js": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest("GET", path, nil), ok)
+		if w.Code != expect {
+			t.Errorf("hey: %s %d", path, w.Code)
+		}
+	}
+}
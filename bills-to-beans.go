@@ -12,7 +12,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/skratchdot/open-golang/open"
 	"log"
-	"math"
 	"os/signal"
 	"sort"
 	"syscall"
@@ -36,14 +35,42 @@ import (
 var developmentMode bool
 var useLocal bool
 
-var appTempDir string
-
 type conf struct {
 	BillsFolder           string `yaml:"bills_folder"`
 	MainBeancountFile     string `yaml:"main_beancount_file"`
 	IncludesBeancountFile string `yaml:"includes_beancount_file"`
 	ServerPort            int    `yaml:"server_port"`
-	InlineBeancounts      bool   `yaml:inline_beancounts`
+	InlineBeancounts      bool   `yaml:"inline_beancounts"`
+	// Decimal places per currency, for currencies which don't use two
+	CurrencyPrecision map[string]int `yaml:"currency_precision"`
+	// Deleted bills are moved here, it must be outside the bills folder
+	TrashFolder string `yaml:"trash_folder"`
+	// Optional passphrase and device tokens for the web app
+	Auth authConf `yaml:"auth"`
+	// Host or IP to listen on, all interfaces when empty
+	ListenAddress string `yaml:"listen_address"`
+	// Unix socket to listen on instead of ListenAddress and ServerPort
+	ListenSocket  string `yaml:"listen_socket"`
+	TLSCert       string `yaml:"tls_cert"`
+	TLSKey        string `yaml:"tls_key"`
+	TLSSelfSigned bool   `yaml:"tls_self_signed"`
+	// Column mappings of bank CSV exports, by name
+	CSVProfiles map[string]csvProfile `yaml:"csv_profiles"`
+	// Accounts of imported statements, by the bank's account number
+	ImportAccounts map[string]string `yaml:"import_accounts"`
+	// How many days apart two transactions can be to look like duplicates
+	DuplicateDays int `yaml:"duplicate_days"`
+	// How amounts and dates are typed in the web app
+	InputLocale inputLocale `yaml:"input_locale"`
+	// text/template of the folders under BillsFolder and of the bill folder
+	// name, see layout.go
+	BillFolderTemplate string `yaml:"bill_folder_template"`
+	BillNameTemplate   string `yaml:"bill_name_template"`
+	// Characters to leave out of folder names besides the ones which are not
+	// letters, numbers or currency symbols, such as "'$"
+	FilenameForbiddenChars string `yaml:"filename_forbidden_chars"`
+	// Longest folder name in characters, 100 when not set
+	FilenameMaxLength int `yaml:"filename_max_length"`
 }
 
 func (c *conf) readConf() *conf {
@@ -53,6 +80,8 @@ func (c *conf) readConf() *conf {
 		IncludesBeancountFile: "./includes.beancount",
 		ServerPort:            3030,
 		InlineBeancounts:      false,
+		TrashFolder:           "./trash",
+		DuplicateDays:         3,
 	}
 
 	yamlFile, err := ioutil.ReadFile("config.yml")
@@ -69,6 +98,10 @@ func (c *conf) readConf() *conf {
 	}
 
 	mergo.MergeWithOverwrite(&theconf, yamlConf)
+
+	if _, _, err = theconf.layoutTemplates(); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
 	*c = theconf
 
 	return &theconf
@@ -101,19 +134,56 @@ type auxiliary_note struct {
 	Description string `json:"description"`
 }
 
+// MetaEntry is a metadata line, the Value is kept as beancount syntax, with
+// quotes around strings.
+type MetaEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type Metadata []MetaEntry
+
+// Get returns the value of the key, with the quotes removed from strings.
+func (meta Metadata) Get(key string) string {
+	for _, m := range meta {
+		if m.Key == key {
+			if v, err := strconv.Unquote(m.Value); err == nil {
+				return v
+			}
+			return m.Value
+		}
+	}
+	return ""
+}
+
+func (meta Metadata) format(indent string) string {
+	out := ""
+	for _, m := range meta {
+		out = out + fmt.Sprintf("\n%s%s: %s", indent, m.Key, m.Value)
+	}
+	return out
+}
+
 type Posting struct {
-	Flag      string  `json:"flag"`
-	Account   string  `json:"account"`
-	Amount    float64 `json:"amount"`
-	Currency  string  `json:"currency"`
+	Flag     string  `json:"flag"`
+	Account  string  `json:"account"`
+	Amount   Decimal `json:"amount"`
+	Currency string  `json:"currency"`
+	// Cost and Price are kept as written, such as "{10.00 USD}" and "@ 1.10 USD"
+	Cost      string   `json:"cost"`
+	Price     string   `json:"price"`
+	Meta      Metadata `json:"meta"`
 	padlength int
 }
 
 type auxiliary_posting struct {
-	Flag     string `json:"flag"`
-	Account  string `json:"account"`
-	Amount   string `json:"amount"`
-	Currency string `json:"currency"`
+	Flag     string   `json:"flag"`
+	Account  string   `json:"account"`
+	Amount   string   `json:"amount"`
+	Currency string   `json:"currency"`
+	Cost     string   `json:"cost"`
+	Price    string   `json:"price"`
+	Meta     Metadata `json:"meta"`
 }
 
 type Transaction struct {
@@ -122,7 +192,8 @@ type Transaction struct {
 	Payee     string    `json:"payee"`
 	Narration string    `json:"narration"`
 	Tags      []string  `json:"tags"`
-	Link      string    `json:"link"`
+	Links     []string  `json:"links"`
+	Meta      Metadata  `json:"meta"`
 	Postings  []Posting `json:"postings"`
 }
 
@@ -133,12 +204,14 @@ type auxiliary_transaction struct {
 	Narration string              `json:"narration"`
 	Tags      []string            `json:"tags"`
 	Link      string              `json:"link"`
+	Links     []string            `json:"links"`
+	Meta      Metadata            `json:"meta"`
 	Postings  []auxiliary_posting `json:"postings"`
 }
 
 type Balance struct {
 	Date          time.Time `json:"date"`
-	Amount        float64   `json:"amount"`
+	Amount        Decimal   `json:"amount"`
 	Currency      string    `json:"currency"`
 	SourceAccount string    `json:"source_account"`
 	TargetAccount string    `json:"target_account"`
@@ -159,7 +232,9 @@ type Bill struct {
 	Balances     []Balance     `json:"balances"`
 	Documents    []Document    `json:"documents"`
 	Notes        []Note        `json:"notes"`
-	DirPath      string
+	DirPath      string        `json:"dir_path"`
+	// where the uploaded documents are waiting
+	StagingDir string `json:"-"`
 }
 
 type auxiliary_bill struct {
@@ -167,14 +242,11 @@ type auxiliary_bill struct {
 	Balances     []auxiliary_balance     `json:"balances"`
 	Documents    []auxiliary_document    `json:"documents"`
 	Notes        []auxiliary_note        `json:"notes"`
-}
-
-func sanitizeFilename(text string) string {
-	portuguese := `ãâáàẽêéèĩîíìõôóòũûúùçÃÂÁÀẼÊÉÈĨÎÍÌÕÔÓÒŨÛÚÙÇ`
-	currency := `€£\$`
-	out := regexp.MustCompile(`[^\w\.\'`+portuguese+currency+`-]`).ReplaceAllString(text, " ")
-	out = regexp.MustCompile(`  +`).ReplaceAllString(out, " ")
-	return out
+	// the folder of the bill being edited, empty for new bills
+	DirPath string `json:"dir_path"`
+	DraftID string `json:"draft_id"`
+	// save even when it looks like a duplicate of a saved bill
+	AllowDuplicates bool `json:"allow_duplicates"`
 }
 
 // Check if a path exists
@@ -190,6 +262,34 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
+// writeFileAtomic replaces the file with a temp file renamed over it, so
+// readers see either the old or the new content. The file keeps its mode.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
 // UniqStr returns a copy of the passed slice with only unique string results.
 // http://www.golangbootcamp.com/book/tricks_and_tips
 func UniqStr(col []string) []string {
@@ -209,6 +309,19 @@ func UniqStr(col []string) []string {
 	return list
 }
 
+// UniqStrOrdered is like UniqStr but keeps the first occurrences in order.
+func UniqStrOrdered(col []string) []string {
+	m := map[string]struct{}{}
+	list := []string{}
+	for _, v := range col {
+		if _, ok := m[v]; !ok {
+			m[v] = struct{}{}
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func figletString(text string) string {
 	ascii := figlet4go.NewAsciiRender()
 	renderStr, _ := ascii.Render(text)
@@ -235,9 +348,13 @@ func (d Document) String() string {
 	)
 }
 
+// Copy copies the uploaded document from the staging folder to dst.
 // http://stackoverflow.com/a/21061062/195141
-func (d Document) Copy(dst string) error {
-	in, err := os.Open(filepath.Join(appTempDir, d.Filename))
+func (d Document) Copy(stagingDir string, dst string) error {
+	in, err := os.Open(filepath.Join(stagingDir, d.Filename))
+	if os.IsNotExist(err) {
+		return badRequest(errors.New(fmt.Sprintf("The document was not uploaded: %s", d.Filename)))
+	}
 	if err != nil {
 		return err
 	}
@@ -270,10 +387,10 @@ func (b Balance) String() string {
 
 	out = append(out,
 		fmt.Sprintf(
-			"%s balance %s %.2f %s",
+			"%s balance %s %s %s",
 			b.Date.Format("2006-01-02"),
 			b.SourceAccount,
-			b.Amount,
+			b.Amount.FormatCurrency(b.Currency),
 			b.Currency,
 		))
 
@@ -298,8 +415,14 @@ func (p Posting) String() string {
 		}
 	}
 
-	if p.Amount != 0.0 && len(p.Currency) > 0 {
-		out = out + fmt.Sprintf(" %.2f %s", p.Amount, p.Currency)
+	if !p.Amount.IsZero() && len(p.Currency) > 0 {
+		out = out + fmt.Sprintf(" %s %s", p.Amount.FormatCurrency(p.Currency), p.Currency)
+	}
+	if len(p.Cost) > 0 {
+		out = out + " " + p.Cost
+	}
+	if len(p.Price) > 0 {
+		out = out + " " + p.Price
 	}
 	return out
 }
@@ -341,11 +464,12 @@ func (t Transaction) String() string {
 		t.flagFmt(),
 		t.titleFmt(),
 		s.Join(t.Tags, " "),
-		t.Link,
+		s.Join(t.Links, " "),
 	}
 
 	out = out + regexp.MustCompile(`  +`).ReplaceAllString(s.Join(firstLineParts, " "), " ")
 	out = s.TrimSpace(out)
+	out = out + t.Meta.format("  ")
 
 	longest := 0
 	for _, p := range t.Postings {
@@ -356,10 +480,11 @@ func (t Transaction) String() string {
 
 	for _, p := range t.Postings {
 		p.padlength = longest + 1
-		if p.Amount >= 0 {
+		if p.Amount.Sign() >= 0 {
 			p.padlength++
 		}
 		out = out + fmt.Sprintf("\n  %s", p.String())
+		out = out + p.Meta.format("    ")
 	}
 
 	return out
@@ -384,7 +509,7 @@ func (t Transaction) sumAmountFmt() string {
 			currency = "$"
 		}
 
-		return fmt.Sprintf("%s%.2f", currency, math.Abs(t.Postings[0].Amount))
+		return currency + t.Postings[0].Amount.Abs().FormatCurrency(t.Postings[0].Currency)
 	}
 	return ""
 }
@@ -439,58 +564,60 @@ func (b Bill) String() string {
 		strs = append(strs, note.String())
 	}
 
-	// TODO front-end will have to fill in missing account and date info
-	//for _, doc := range b.Documents {
-	//	doc.DirPath = b.DirPath
-	//	strs = append(strs, doc.String())
-	//}
+	date, account := b.documentDefaults()
+
+	for _, doc := range b.Documents {
+		if len(doc.Filename) == 0 {
+			continue
+		}
+		if doc.Date.IsZero() {
+			doc.Date = date
+		}
+		if len(doc.Account) == 0 {
+			doc.Account = account
+		}
+		// not a valid directive without an account
+		if len(doc.Account) == 0 {
+			continue
+		}
+		strs = append(strs, doc.String())
+	}
 
 	return s.Join(strs, "\n\n")
 }
 
-// Uses globals: config
-func (b *Bill) EnsureDirPath() error {
-	var err error
-
-	// Use the first Transaction or Balance
+// documentDefaults are the date and account of the document directives which
+// don't have their own: the first transaction's date and first posting.
+func (b Bill) documentDefaults() (time.Time, string) {
+	var account string
 
 	if len(b.Transactions) > 0 {
-		t := b.Transactions[0]
-		b.DirPath = filepath.Join(
-			config.BillsFolder,
-			fmt.Sprintf("%04d", t.Date.Year()),
-			fmt.Sprintf("%02d", t.Date.Month()),
-			t.sanitizedBase(),
-		)
+		for _, p := range b.Transactions[0].Postings {
+			if len(p.Account) > 0 {
+				account = p.Account
+				break
+			}
+		}
 	} else if len(b.Balances) > 0 {
-		bal := b.Balances[0]
-		b.DirPath = filepath.Join(
-			config.BillsFolder,
-			fmt.Sprintf("%04d", bal.Date.Year()),
-			fmt.Sprintf("%02d", bal.Date.Month()),
-			bal.sanitizedBase(),
-		)
+		account = b.Balances[0].SourceAccount
 	} else if len(b.Notes) > 0 {
-		note := b.Notes[0]
-		b.DirPath = filepath.Join(
-			config.BillsFolder,
-			fmt.Sprintf("%04d", note.Date.Year()),
-			fmt.Sprintf("%02d", note.Date.Month()),
-			note.sanitizedBase(),
-		)
-	} else {
-		return errors.New(fmt.Sprintf("Need at least one transaction, balance or note"))
+		account = b.Notes[0].Account
 	}
 
-	if ex, _ := exists(b.DirPath); ex {
-		return errors.New(fmt.Sprintf("Already exists: %s", b.DirPath))
-	}
+	return b.Date(), account
+}
 
-	if err = os.MkdirAll(b.DirPath, 0755); err != nil {
-		return err
+// Date is the date of the first Transaction, Balance or Note, the same
+// entry which decides the folder.
+func (b Bill) Date() time.Time {
+	if len(b.Transactions) > 0 {
+		return b.Transactions[0].Date
+	} else if len(b.Balances) > 0 {
+		return b.Balances[0].Date
+	} else if len(b.Notes) > 0 {
+		return b.Notes[0].Date
 	}
-
-	return nil
+	return time.Time{}
 }
 
 func (b Bill) BeancountFilename() string {
@@ -520,40 +647,21 @@ func (b *Bill) SaveBeancount() error {
 	return nil
 }
 
+// ParseBeancount reads the first transaction of the text. Errors in other
+// directives are returned as well.
 func (t *Transaction) ParseBeancount(text string) error {
-	text = s.TrimSpace(text)
-	firstLine := s.TrimSpace(s.Split(text, "\n")[0])
-
-	re := regexp.MustCompile(`^([^ ]+) ([\*\!]) *("[^"]+")?[ \|]*("[^"]+")?`)
-	matches := re.FindStringSubmatch(firstLine)
-
-	if len(matches) > 0 {
-		t.Date, _ = time.Parse("2006-01-02", matches[1])
-		t.Flag = matches[2]
-		// matches[0] is the complete matched string
-		if len(matches[4]) > 0 {
-			t.Payee = s.Trim(matches[3], `"`)
-			t.Narration = s.Trim(matches[4], `"`)
-		} else {
-			t.Narration = s.Trim(matches[3], `"`)
-		}
-	} else {
-		return errors.New("no matches")
-	}
+	ledger, err := ParseBeancount(text)
 
-	re = regexp.MustCompile(`#[\w-]+`)
-	matches = re.FindAllString(firstLine, -1)
-	if matches != nil {
-		t.Tags = matches
+	if len(ledger.Transactions) == 0 {
+		if err != nil {
+			return err
+		}
+		return errors.New("no transactions")
 	}
 
-	re = regexp.MustCompile(`\^[\w-]+`)
-	match := re.FindString(firstLine)
-	if len(match) != 0 {
-		t.Link = match
-	}
+	*t = ledger.Transactions[0]
 
-	return nil
+	return err
 }
 
 func (b *Bill) SaveDocuments() (err error) {
@@ -561,15 +669,18 @@ func (b *Bill) SaveDocuments() (err error) {
 		if len(doc.Filename) == 0 {
 			continue
 		}
+		if err = validateFilename(doc.Filename); err != nil {
+			return err
+		}
 		newpath := filepath.Join(b.DirPath, doc.Filename)
 		ex, err := exists(newpath)
 		if ex {
-			return errors.New(fmt.Sprintf("File already exists: %s", newpath))
+			return conflict(errors.New(fmt.Sprintf("File already exists: %s", newpath)))
 		}
 		if err != nil {
 			return err
 		}
-		err = doc.Copy(newpath)
+		err = doc.Copy(b.StagingDir, newpath)
 		if err != nil {
 			return err
 		}
@@ -578,16 +689,77 @@ func (b *Bill) SaveDocuments() (err error) {
 	return nil
 }
 
-func (b *Bill) Save(c conf) error {
-	var err error
+// freeDirPath returns dirPath, or when it is taken by another bill, the first
+// free one of "dirPath _ 2", "dirPath _ 3" and so on. own is the folder of the
+// bill itself when it is moved, it counts as free.
+func freeDirPath(dirPath string, own string) (string, error) {
+	for n := 1; n < 1000; n++ {
+		candidate := dirPath
+		if n > 1 {
+			candidate = fmt.Sprintf("%s _ %d", dirPath, n)
+		}
+		if len(own) > 0 && filepath.Clean(candidate) == filepath.Clean(own) {
+			return candidate, nil
+		}
+		ex, err := exists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !ex {
+			return candidate, nil
+		}
+	}
+	return "", conflict(errors.New(fmt.Sprintf("Already exists: %s", dirPath)))
+}
 
-	// be create about new folders, don't just error out
-	// rather duplicate than delete
+// Bills are built in a folder with this prefix inside the bills folder, and
+// renamed into place when complete. The bill globs don't reach it.
+const saveStagingPrefix = ".b2b-save-"
 
-	if err = b.EnsureDirPath(); err != nil {
+// Save writes the bill folder all or nothing. When a step fails, what was
+// written so far is removed, and saving again can be retried.
+func (b *Bill) Save(c conf) (err error) {
+	if err = b.checkDocumentFilenames(); err != nil {
 		return err
 	}
 
+	target, err := c.layoutDirPath(*b)
+	if err != nil {
+		return err
+	}
+
+	billsFolderExisted, _ := exists(c.BillsFolder)
+	if err = os.MkdirAll(c.BillsFolder, 0755); err != nil {
+		return err
+	}
+
+	stage, err := ioutil.TempDir(c.BillsFolder, saveStagingPrefix)
+	if err != nil {
+		if !billsFolderExisted {
+			os.Remove(c.BillsFolder)
+		}
+		return err
+	}
+
+	moved := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if moved {
+			os.RemoveAll(target)
+		} else {
+			os.RemoveAll(stage)
+		}
+		removeEmptyDirs(filepath.Dir(target), c.BillsFolder)
+		if !billsFolderExisted {
+			os.Remove(c.BillsFolder)
+		}
+		b.DirPath = ""
+	}()
+
+	b.DirPath = stage
+
 	if err = b.SaveBeancount(); err != nil {
 		return err
 	}
@@ -596,6 +768,31 @@ func (b *Bill) Save(c conf) error {
 		return err
 	}
 
+	if err = os.Chmod(stage, 0755); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// checked last, for bills saved in the meantime, and again when another
+	// save took the folder between the check and the rename
+	layoutTarget := target
+	for tries := 1; ; tries++ {
+		if target, err = freeDirPath(layoutTarget, ""); err != nil {
+			return err
+		}
+		if err = os.Rename(stage, target); err == nil {
+			break
+		}
+		if !os.IsExist(err) || tries == 10 {
+			return err
+		}
+	}
+	moved = true
+	b.DirPath = target
+
 	if err = c.updateIncludesBeancountFile(); err != nil {
 		return err
 	}
@@ -603,79 +800,188 @@ func (b *Bill) Save(c conf) error {
 	return nil
 }
 
-func (aux_bal auxiliary_balance) ToBalance() Balance {
-	var date time.Time
-	if len(aux_bal.Date) >= 10 {
-		date, _ = time.Parse("2006-01-02", aux_bal.Date[0:10])
-	} else {
-		date = time.Now()
+func (aux_bal auxiliary_balance) ToBalance(l inputLocale) (Balance, []fieldError) {
+	var errs []fieldError
+
+	date, err := l.parseDate(aux_bal.Date)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "date", Message: err.Error()})
 	}
 
-	amount, _ := strconv.ParseFloat(aux_bal.Amount, 64)
+	amount, symbolCurrency, err := l.parseAmount(aux_bal.Amount)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "amount", Message: err.Error()})
+	} else if len(s.TrimSpace(aux_bal.Amount)) == 0 {
+		// a balance of nothing is written as 0
+		errs = append(errs, fieldError{Field: "amount", Message: "Amount is missing"})
+	}
+
+	currency, err := amountCurrency(aux_bal.Currency, symbolCurrency)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "amount", Message: err.Error()})
+	}
 
 	bal := Balance{
 		Date:          date,
 		Amount:        amount,
-		Currency:      aux_bal.Currency,
+		Currency:      currency,
 		SourceAccount: aux_bal.SourceAccount,
-		//TargetAccount:  aux_bal.TargetAccount,
-		//Padded: aux_bal.Padded,
 	}
 
-	return bal
+	// a pad needs the account to pad from
+	if aux_bal.Padded && len(aux_bal.TargetAccount) > 0 {
+		bal.Padded = true
+		bal.TargetAccount = aux_bal.TargetAccount
+	}
+
+	return bal, errs
 }
 
-func isostrToDate(text string) time.Time {
-	var date time.Time
-	if len(text) >= 10 {
-		date, _ = time.Parse("2006-01-02", text[0:10])
-	} else {
-		date = time.Now()
+func (aux_note auxiliary_note) ToNote(l inputLocale) (Note, []fieldError) {
+	var errs []fieldError
+
+	date, err := l.parseDate(aux_note.Date)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "date", Message: err.Error()})
 	}
-	return date
-}
 
-func (aux_note auxiliary_note) ToNote() Note {
 	return Note{
-		Date:        isostrToDate(aux_note.Date),
+		Date:        date,
 		Account:     aux_note.Account,
 		Description: aux_note.Description,
-	}
+	}, errs
 }
 
-func (aux_doc auxiliary_document) ToDocument() Document {
-	return Document{
-		Date:     isostrToDate(aux_doc.Date),
+func (aux_doc auxiliary_document) ToDocument(l inputLocale) (Document, []fieldError) {
+	var errs []fieldError
+
+	doc := Document{
 		Account:  aux_doc.Account,
 		Filename: aux_doc.Filename,
 	}
+	// left empty, the bill's date is used
+	if len(aux_doc.Date) > 0 {
+		date, err := l.parseDate(aux_doc.Date)
+		if err != nil {
+			errs = append(errs, fieldError{Field: "date", Message: err.Error()})
+		}
+		doc.Date = date
+	}
+	return doc, errs
 }
 
-func (aux_txn auxiliary_transaction) ToTransaction() Transaction {
+func (aux_txn auxiliary_transaction) ToTransaction(l inputLocale) (Transaction, []fieldError) {
+	var errs []fieldError
+
+	date, err := l.parseDate(aux_txn.Date)
+	if err != nil {
+		errs = append(errs, fieldError{Field: "date", Message: err.Error()})
+	}
+
 	txn := Transaction{
-		Date:      isostrToDate(aux_txn.Date),
+		Date:      date,
 		Flag:      aux_txn.Flag,
 		Payee:     s.Replace(aux_txn.Payee, `"`, `'`, -1),
 		Narration: s.Replace(aux_txn.Narration, `"`, `'`, -1),
+		Meta:      aux_txn.Meta,
+	}
+
+	for _, tag := range aux_txn.Tags {
+		if tag = s.TrimSpace(tag); len(tag) > 0 {
+			txn.Tags = append(txn.Tags, "#"+s.TrimPrefix(tag, "#"))
+		}
+	}
+
+	for _, link := range append([]string{aux_txn.Link}, aux_txn.Links...) {
+		if link = s.TrimSpace(link); len(link) > 0 {
+			txn.Links = append(txn.Links, "^"+s.TrimPrefix(link, "^"))
+		}
 	}
 
-	for _, p := range aux_txn.Postings {
-		amount, _ := strconv.ParseFloat(p.Amount, 64)
+	txn.Tags = UniqStrOrdered(txn.Tags)
+	txn.Links = UniqStrOrdered(txn.Links)
+
+	for i, p := range aux_txn.Postings {
+		amount, symbolCurrency, err := l.parseAmount(p.Amount)
+		if err != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("postings[%d].amount", i), Message: err.Error()})
+		}
+		currency, err := amountCurrency(p.Currency, symbolCurrency)
+		if err != nil {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("postings[%d].amount", i), Message: err.Error()})
+		}
 		txn.Postings = append(txn.Postings,
 			Posting{
 				Flag:     p.Flag,
 				Account:  p.Account,
 				Amount:   amount,
-				Currency: p.Currency,
+				Currency: currency,
+				Cost:     p.Cost,
+				Price:    p.Price,
+				Meta:     p.Meta,
 			},
 		)
 	}
 
-	return txn
+	return txn, errs
 }
 
-func MyClassic() *negroni.Negroni {
-	return negroni.New(negroni.NewRecovery(), negroni.NewLogger(), negroni.NewStatic(Dir(useLocal, "/public")))
+// ToBill converts the bill sent by the web app, reading dates and amounts as
+// written in the locale. Dates and amounts which can't be read are returned
+// as a validationError with their fields.
+func (aux_bill auxiliary_bill) ToBill(l inputLocale) (Bill, error) {
+	var bill Bill
+	var errs []fieldError
+
+	// Documents
+
+	for i, aux_doc := range aux_bill.Documents {
+		doc, docErrs := aux_doc.ToDocument(l)
+		errs = append(errs, prefixFields(fmt.Sprintf("documents[%d]", i), docErrs)...)
+		bill.Documents = append(bill.Documents, doc)
+	}
+
+	// Transactions
+
+	for i, aux_txn := range aux_bill.Transactions {
+		txn, txnErrs := aux_txn.ToTransaction(l)
+		errs = append(errs, prefixFields(fmt.Sprintf("transactions[%d]", i), txnErrs)...)
+		bill.Transactions = append(bill.Transactions, txn)
+	}
+
+	// Balances
+
+	for i, aux_bal := range aux_bill.Balances {
+		bal, balErrs := aux_bal.ToBalance(l)
+		errs = append(errs, prefixFields(fmt.Sprintf("balances[%d]", i), balErrs)...)
+		bill.Balances = append(bill.Balances, bal)
+	}
+
+	// Notes
+
+	for i, aux_note := range aux_bill.Notes {
+		note, noteErrs := aux_note.ToNote(l)
+		errs = append(errs, prefixFields(fmt.Sprintf("notes[%d]", i), noteErrs)...)
+		bill.Notes = append(bill.Notes, note)
+	}
+
+	if len(errs) > 0 {
+		return bill, validationError{Fields: errs}
+	}
+	return bill, nil
+}
+
+// Uses globals: authn
+func MyClassic(c conf) *negroni.Negroni {
+	n := negroni.New(negroni.NewRecovery(), negroni.NewLogger())
+	// before the static files, which need a session as well
+	if c.Auth.enabled() {
+		authn = newAuthenticator(c.Auth)
+		authn.behindProxy = len(c.ListenSocket) > 0
+		n.Use(authn)
+	}
+	n.Use(negroni.NewStatic(Dir(useLocal, "/public")))
+	return n
 }
 
 // GetLocalIP returns the non loopback local IP of the host
@@ -697,49 +1003,183 @@ func GetLocalIP() string {
 	return ""
 }
 
+// badRequestError marks errors caused by invalid client input.
+type badRequestError struct {
+	error
+}
+
+func badRequest(err error) error {
+	return badRequestError{err}
+}
+
+// conflictError marks requests which clash with what is on disk, such as a
+// file which already exists.
+type conflictError struct {
+	error
+}
+
+func conflict(err error) error {
+	return conflictError{err}
+}
+
+// notFoundError marks requests for paths the API doesn't have.
+type notFoundError struct {
+	error
+}
+
+func notFound(err error) error {
+	return notFoundError{err}
+}
+
+// methodNotAllowedError marks requests with a method the API path doesn't
+// take, such as a GET of /save-bill.
+type methodNotAllowedError struct {
+	error
+}
+
+func methodNotAllowed(err error) error {
+	return methodNotAllowedError{err}
+}
+
+// apiError is the error envelope of the JSON API:
+//
+//	{"error": {"code": "invalid", "message": "...", "fields": [...]}, "flash": "..."}
+//
+// flash has the message as well, for the web app's notices.
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// errorStatus returns the HTTP status and the code of an error.
+func errorStatus(err error) (int, string) {
+	switch err.(type) {
+	case badRequestError:
+		return http.StatusBadRequest, "bad_request"
+	case validationError:
+		return http.StatusUnprocessableEntity, "invalid"
+	case duplicatesError:
+		return http.StatusConflict, "duplicates"
+	case conflictError:
+		return http.StatusConflict, "conflict"
+	case notFoundError:
+		return http.StatusNotFound, "not_found"
+	case methodNotAllowedError:
+		return http.StatusMethodNotAllowed, "method_not_allowed"
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
 func sendError(w http.ResponseWriter, err error) {
-	data := make(map[string]interface{})
+	sendErrorData(w, err, make(map[string]interface{}))
+}
+
+// sendErrorData sends the error with more keys in data, a "flash" in it
+// replaces the error message.
+func sendErrorData(w http.ResponseWriter, err error, data map[string]interface{}) {
 	msg := fmt.Sprintf("%v", err)
 	log.Println(msg)
+
+	status, code := errorStatus(err)
+	body := apiError{Code: code, Message: msg}
+
+	if verr, ok := err.(validationError); ok {
+		body.Fields = verr.Fields
+	}
+	if dups, ok := err.(duplicatesError); ok {
+		data["duplicates"] = dups.Duplicates
+	}
+
+	data["error"] = body
+	if _, ok := data["flash"]; !ok {
+		data["flash"] = msg
+	}
+
 	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	data["flash"] = msg
+	w.WriteHeader(status)
 	enc := json.NewEncoder(w)
 	enc.Encode(data)
 }
 
+// Uses globals: config, authn
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	data := make(map[string]string)
-	data["localAddress"] = fmt.Sprintf("http://%s:%d", GetLocalIP(), config.ServerPort)
+	data["localAddress"] = config.localAddress(r)
+	if authn != nil {
+		if nonce, ok := authn.session(r); ok {
+			data["csrfToken"] = authn.csrfToken(nonce)
+		}
+	}
 
 	t, _ := template.New("index").Parse(FSMustString(useLocal, "/public/index.html.tmpl"))
 	t.Execute(w, data)
 }
 
-// Uses globals: appTempDir
+// Empties the staging area of the draft, for starting a new bill.
+//
+// Uses globals: staging
 func createNewTempdir(w http.ResponseWriter, r *http.Request) {
-	os.RemoveAll(appTempDir)
-	appTempDir, _ = ioutil.TempDir(os.TempDir(), "bills_")
+	id := draftID(w, r, "")
+
+	area, err := staging.area(id)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	area.mu.Lock()
+	defer area.mu.Unlock()
+
+	if err = area.clear(); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["draft_id"] = id
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
 }
 
-// Uses globals: appTempDir
+// Uses globals: staging
 func removeFromTempdir(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	if err = r.ParseForm(); err != nil {
-		sendError(w, errors.New("Could not remove file"))
+		sendError(w, badRequest(err))
 		return
 	}
 
 	filename := r.PostFormValue("filename")
 
-	if err = os.Remove(filepath.Join(appTempDir, filename)); err != nil {
+	if err = validateFilename(filename); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	area, err := staging.area(draftID(w, r, ""))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	area.mu.Lock()
+	defer area.mu.Unlock()
+
+	if err = os.Remove(filepath.Join(area.dir, filename)); err != nil {
+		if os.IsNotExist(err) {
+			sendError(w, notFound(errors.New(fmt.Sprintf("No uploaded file: %s", filename))))
+			return
+		}
 		sendError(w, errors.New(fmt.Sprintf("Could not remove file: %s", filename)))
 		return
 	}
 }
 
-// Uses globals: config, appTempDir
+// Uses globals: config, staging
 func saveBillHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 
@@ -749,38 +1189,38 @@ func saveBillHandler(w http.ResponseWriter, r *http.Request) {
 	var aux_bill auxiliary_bill
 
 	if err := decoder.Decode(&aux_bill); err != nil {
-		sendError(w, err)
+		sendError(w, badRequest(err))
 		return
 	}
 
-	var bill Bill
-
-	// Documents
-
-	for _, aux_doc := range aux_bill.Documents {
-		doc := aux_doc.ToDocument()
-		bill.Documents = append(bill.Documents, doc)
+	bill, err := aux_bill.ToBill(config.InputLocale)
+	if err != nil {
+		sendError(w, err)
+		return
 	}
 
-	// Transactions
-
-	for _, aux_txn := range aux_bill.Transactions {
-		txn := aux_txn.ToTransaction()
-		bill.Transactions = append(bill.Transactions, txn)
+	area, err := staging.area(draftID(w, r, aux_bill.DraftID))
+	if err != nil {
+		sendError(w, err)
+		return
 	}
 
-	// Balances
+	// Only this draft's uploads are saved, and they can't change meanwhile.
+	area.mu.Lock()
+	defer area.mu.Unlock()
 
-	for _, aux_bal := range aux_bill.Balances {
-		bal := aux_bal.ToBalance()
-		bill.Balances = append(bill.Balances, bal)
-	}
+	bill.StagingDir = area.dir
 
-	// Notes
+	if err := config.checkBill(bill); err != nil {
+		sendError(w, err)
+		return
+	}
 
-	for _, aux_note := range aux_bill.Notes {
-		note := aux_note.ToNote()
-		bill.Notes = append(bill.Notes, note)
+	if !aux_bill.AllowDuplicates {
+		if err := config.checkDuplicates(bill, ""); err != nil {
+			sendError(w, err)
+			return
+		}
 	}
 
 	if err := bill.Save(config); err != nil {
@@ -788,9 +1228,13 @@ func saveBillHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	os.RemoveAll(appTempDir)
-	appTempDir, _ = ioutil.TempDir(os.TempDir(), "bills_")
+	area.clear()
 
+	sendSavedBill(w, bill)
+}
+
+// sendSavedBill responds with the folder and the files of a saved bill.
+func sendSavedBill(w http.ResponseWriter, bill Bill) {
 	data := make(map[string]interface{})
 	data["flash"] = "Saved"
 
@@ -819,41 +1263,46 @@ func saveBillHandler(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(data)
 }
 
+// Parse errors are only logged, the directives which could be read are still
+// useful for completions.
+func (c conf) parseMainBeancountFile() (Ledger, error) {
+	ledger, err := ParseBeancountFile(c.MainBeancountFile)
+	if err != nil {
+		if _, ok := err.(ParseErrors); !ok {
+			return ledger, err
+		}
+		log.Printf("%v", err)
+	}
+	return ledger, nil
+}
+
 func (c conf) getAccounts() (account []string, err error) {
-	content, err := ioutil.ReadFile(c.MainBeancountFile)
+	ledger, err := c.parseMainBeancountFile()
 	if err != nil {
 		return []string{}, err
 	}
 
 	data := []string{}
-	var matches [][]string
-
-	re := regexp.MustCompile(`\n[^ ]+ +open +([^ \n]+)`)
 
-	matches = re.FindAllStringSubmatch(string(content), -1)
-
-	for _, m := range matches {
-		data = append(data, m[1])
+	for _, open := range ledger.Opens {
+		data = append(data, open.Account)
 	}
 
 	return data, nil
 }
 
 func (c conf) getCurrencies() (currencies []string, err error) {
-	content, err := ioutil.ReadFile(c.MainBeancountFile)
+	ledger, err := c.parseMainBeancountFile()
 	if err != nil {
 		return []string{}, err
 	}
 
 	data := []string{}
-	var matches [][]string
-
-	re := regexp.MustCompile(`\noption "operating_currency" +"([^ \n]+)"`)
 
-	matches = re.FindAllStringSubmatch(string(content), -1)
-
-	for _, m := range matches {
-		data = append(data, m[1])
+	for _, opt := range ledger.Options {
+		if opt.Name == "operating_currency" {
+			data = append(data, opt.Value)
+		}
 	}
 
 	return data, nil
@@ -861,8 +1310,7 @@ func (c conf) getCurrencies() (currencies []string, err error) {
 
 // Uses globals: config
 func completionsHandler(w http.ResponseWriter, r *http.Request) {
-	globpath := filepath.Join(config.BillsFolder, "*", "*", "*", "*.beancount")
-	paths, _ := filepath.Glob(globpath)
+	paths := config.billFilePaths()
 
 	data := make(map[string][]string)
 
@@ -873,23 +1321,16 @@ func completionsHandler(w http.ResponseWriter, r *http.Request) {
 	data["currencies"] = []string{}
 
 	for _, path := range paths {
-		c, _ := ioutil.ReadFile(path)
-		text := string(c)
-		txn := Transaction{}
-		if err := txn.ParseBeancount(text); err != nil {
+		ledger, err := ParseBeancountFile(path)
+		if err != nil {
 			log.Printf("%v", err)
-		} else {
+		}
+		for _, txn := range ledger.Transactions {
 			if len(txn.Payee) > 0 {
 				data["payees"] = append(data["payees"], txn.Payee)
 			}
-			if len(txn.Link) > 0 {
-				data["links"] = append(data["links"], txn.Link)
-			}
-			if len(txn.Tags) > 0 {
-				for _, t := range txn.Tags {
-					data["tags"] = append(data["tags"], t)
-				}
-			}
+			data["links"] = append(data["links"], txn.Links...)
+			data["tags"] = append(data["tags"], txn.Tags...)
 		}
 	}
 
@@ -922,16 +1363,28 @@ func completionsHandler(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(data)
 }
 
+// Uses globals: staging
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	r.ParseMultipartForm(32 << 20) // using 32 MB memory
 
-	file, handler, err := r.FormFile("file")
+	id := draftID(w, r, "")
+
+	area, err := staging.area(id)
 	if err != nil {
 		sendError(w, err)
 		return
 	}
+
+	area.mu.Lock()
+	defer area.mu.Unlock()
+
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
 	defer file.Close()
 
 	//ct := handler.Header.Get("Content-Type")
@@ -942,10 +1395,16 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	//	return
 	//}
 
-	path := filepath.Join(appTempDir, handler.Filename)
+	filename, err := cleanUploadFilename(handler.Filename)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	path := filepath.Join(area.dir, filename)
 
 	if ex, _ := exists(path); ex {
-		sendError(w, errors.New(fmt.Sprintf("Already exists: %s", path)))
+		sendError(w, conflict(errors.New(fmt.Sprintf("Already exists: %s", filename))))
 		return
 	}
 
@@ -965,6 +1424,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	info, _ := f.Stat()
 	data["filename"] = filepath.Base(path)
 	data["size"] = info.Size()
+	data["draft_id"] = id
 
 	// Simulate waiting time for upload during development
 	if developmentMode {
@@ -976,12 +1436,30 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	enc.Encode(data)
 }
 
-// uses globals: config
+// documentDirectiveRe matches a document directive, with its path quoted.
+var documentDirectiveRe = regexp.MustCompile(`(?m)^(\d{4}-\d{2}-\d{2}\s+document\s+\S+\s+)("(?:[^"\\]|\\.)*")`)
+
+// inlineDocumentPaths makes the document paths of a bill file, which are
+// relative to the bill file, relative to the includes file it is inlined in.
+func (c conf) inlineDocumentPaths(path string, text string) string {
+	return documentDirectiveRe.ReplaceAllStringFunc(text, func(line string) string {
+		m := documentDirectiveRe.FindStringSubmatch(line)
+		filename, err := strconv.Unquote(m[2])
+		if err != nil || filepath.IsAbs(filename) {
+			return line
+		}
+		rel, err := filepath.Rel(filepath.Dir(c.IncludesBeancountFile), filepath.Join(filepath.Dir(path), filename))
+		if err != nil {
+			return line
+		}
+		return fmt.Sprintf("%s%q", m[1], filepath.ToSlash(rel))
+	})
+}
+
 func (c conf) updateIncludesBeancountFile() error {
 	var err error
 
-	globpath := filepath.Join(config.BillsFolder, "*", "*", "*", "*.beancount")
-	paths, _ := filepath.Glob(globpath)
+	paths := c.billFilePaths()
 
 	var billTexts []string
 	var content []byte
@@ -990,16 +1468,16 @@ func (c conf) updateIncludesBeancountFile() error {
 	for _, path := range paths {
 		if c.InlineBeancounts {
 			content, _ = ioutil.ReadFile(path)
-			text = string(content) + "\n"
+			text = c.inlineDocumentPaths(path, string(content)) + "\n"
 		} else {
-			relpath, _ := filepath.Rel(filepath.Dir(config.IncludesBeancountFile), path)
+			relpath, _ := filepath.Rel(filepath.Dir(c.IncludesBeancountFile), path)
 			text = fmt.Sprintf(`include %q`, relpath)
 		}
 		billTexts = append(billTexts, text)
 	}
 
 	// don't check if exists, overwrite
-	f, err := os.OpenFile(config.IncludesBeancountFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(c.IncludesBeancountFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
@@ -1012,23 +1490,38 @@ func (c conf) updateIncludesBeancountFile() error {
 }
 
 func (c conf) startWebApp() {
-	port := c.ServerPort
 	router := mux.NewRouter()
 
 	router.HandleFunc("/", indexHandler).Methods("GET")
 
 	router.HandleFunc("/save-bill", saveBillHandler).Methods("POST")
+	router.HandleFunc("/bill.json", billHandler).Methods("GET")
+	router.HandleFunc("/update-bill", updateBillHandler).Methods("POST")
+	router.HandleFunc("/bills", listBillsHandler).Methods("GET")
+	router.HandleFunc("/delete-bill", deleteBillHandler).Methods("POST")
+	router.HandleFunc("/restore-bill", restoreBillHandler).Methods("POST")
+	router.HandleFunc("/trash.json", trashHandler).Methods("GET")
 	router.HandleFunc("/upload", uploadHandler).Methods("POST")
+	router.HandleFunc("/import/{format}", importHandler).Methods("POST")
 
 	router.HandleFunc("/new-tempdir", createNewTempdir).Methods("POST")
 	router.HandleFunc("/remove-from-tempdir", removeFromTempdir).Methods("POST")
 
 	router.HandleFunc("/completions.json", completionsHandler).Methods("GET")
+	router.HandleFunc("/tags.json", tagsHandler).Methods("GET")
+	router.HandleFunc("/rename-tags", renameTagsHandler).Methods("POST")
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendError(w, notFound(errors.New(fmt.Sprintf("Not found: %s %s", r.Method, r.URL.Path))))
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sendError(w, methodNotAllowed(errors.New(fmt.Sprintf("Method not allowed: %s %s", r.Method, r.URL.Path))))
+	})
 
-	n := MyClassic()
+	n := MyClassic(c)
 	n.UseHandler(router)
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	l, err := c.listen()
 	if err != nil {
 		log.Fatal(err)
 		// just to keep spew in the imports
@@ -1037,7 +1530,7 @@ func (c conf) startWebApp() {
 
 	// Print welcome message
 	fmt.Println(figletString("B2B"))
-	fmt.Printf("Listening on http://localhost:%d\n", port)
+	fmt.Printf("Listening on %s\n", c.listenURL())
 
 	config.openBrowser()
 
@@ -1046,18 +1539,19 @@ func (c conf) startWebApp() {
 }
 
 func (c conf) openBrowser() {
-	if developmentMode {
+	if developmentMode || len(c.ListenSocket) > 0 {
 		return
 	}
-	err := open.Start(fmt.Sprintf("http://localhost:%d", c.ServerPort))
+	err := open.Start(c.listenURL())
 	if err != nil {
 		log.Println(err)
 	}
 }
 
+// uses globals: staging
 func cleanup() {
-	log.Printf("removing app temp folder %s", appTempDir)
-	os.RemoveAll(appTempDir)
+	log.Printf("removing app temp folder %s", staging.root)
+	staging.cleanup()
 }
 
 // uses globals: config
@@ -1161,7 +1655,7 @@ func main() {
 		useLocal = false
 	}
 
-	appTempDir, err = ioutil.TempDir(os.TempDir(), "bills_")
+	staging, err = newStagingRegistry()
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -1184,11 +1678,58 @@ func main() {
 			Usage:  "watch the bills folder for changes and update the includes file",
 			Action: actionWatch,
 		},
+		{
+			Name:      "delete",
+			Usage:     "move a bill folder to the trash folder",
+			ArgsUsage: "BILL_FOLDER",
+			Action:    actionDelete,
+		},
+		{
+			Name:      "restore",
+			Usage:     "move a deleted bill back from the trash folder",
+			ArgsUsage: "TRASH_ID",
+			Action:    actionRestore,
+		},
+		{
+			Name:   "trash",
+			Usage:  "list the deleted bills in the trash folder",
+			Action: actionTrash,
+		},
+		{
+			Name:        "import",
+			Usage:       "save a bill for each line of a bank statement",
+			Subcommands: importCommands(),
+		},
+		{
+			Name:        "tags",
+			Usage:       "list, rename and merge the tags and links of the bills",
+			Subcommands: tagsCommands,
+		},
+		{
+			Name:      "rename-account",
+			Usage:     "rename an account and its sub-accounts in every beancount file",
+			ArgsUsage: "OLD NEW",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run", Usage: "print the changes instead of writing them"},
+			},
+			Action: actionRenameAccount,
+		},
+		{
+			Name:  "reorganise",
+			Usage: "move the bills to the folders the layout gives them now",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "apply", Usage: "move the bills, instead of only printing the plan"},
+			},
+			Action: actionReorganise,
+		},
 	}
 
+	app.Flags = listenFlags
+
 	app.Action = func(c *cli.Context) error {
 		// No arguments, so we're a desktop web app
 		if c.NArg() < 1 {
+			config.applyListenFlags(c)
 			if err = config.updateIncludesBeancountFile(); err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -2,9 +2,15 @@ package main
 
 import (
 	//"github.com/davecgh/go-spew/spew"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	s "strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,12 +20,16 @@ func isodate(str string) time.Time {
 	return d
 }
 
+func dec(str string) Decimal {
+	return MustDecimal(str)
+}
+
 func TestBalanceString(t *testing.T) {
 	var balances = map[Balance]string{
 
 		Balance{
 			Date:          isodate("2016-03-21"),
-			Amount:        324.25,
+			Amount:        dec("324.25"),
 			Currency:      "EUR",
 			SourceAccount: "Assets:Bank:Checking",
 			Padded:        false,
@@ -27,7 +37,7 @@ func TestBalanceString(t *testing.T) {
 
 		Balance{
 			Date:          isodate("2016-03-21"),
-			Amount:        324.25,
+			Amount:        dec("324.25"),
 			Currency:      "EUR",
 			SourceAccount: "Assets:Bank:Checking",
 			TargetAccount: "Equity:Opening-Balances",
@@ -55,12 +65,12 @@ func TestTransactionString(t *testing.T) {
 		Payee:     `Café de 'João'`,
 		Narration: `dois "X" café por cabeça`,
 		Tags:      []string{"#coffee", "#portugal"},
-		Link:      "^holiday-2016",
+		Links:     []string{"^holiday-2016"},
 		Postings: []Posting{
-			Posting{Account: "Assets:Bank:Checking", Amount: -5.50, Currency: "EUR"},
-			Posting{Account: "Assets:Bank:PettyCash", Amount: -2.50, Currency: "EUR"},
-			Posting{Account: "Expenses:Coffee", Amount: 5.50, Currency: "EUR"},
-			Posting{Account: "Expenses:Tips", Amount: 2.50, Currency: "EUR"},
+			Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+			Posting{Account: "Assets:Bank:PettyCash", Amount: dec("-2.50"), Currency: "EUR"},
+			Posting{Account: "Expenses:Coffee", Amount: dec("5.50"), Currency: "EUR"},
+			Posting{Account: "Expenses:Tips", Amount: dec("2.50"), Currency: "EUR"},
 		},
 	}
 
@@ -80,10 +90,10 @@ func TestTransactionString(t *testing.T) {
 func TestDocumentString(t *testing.T) {
 	documents := map[Document]string{
 		Document{
-			Date:    isodate("2015-08-11"),
-			Account: "Assets:Bank:Checking",
-			Path:    `./today's "best" scans.pdf`,
-		}: `2015-08-11 document Assets:Bank:Checking "./today's \"best\" scans.pdf"`,
+			Date:     isodate("2015-08-11"),
+			Account:  "Assets:Bank:Checking",
+			Filename: `today's "best" scans.pdf`,
+		}: `2015-08-11 document Assets:Bank:Checking "today's \"best\" scans.pdf"`,
 	}
 
 	for doc, expect := range documents {
@@ -94,13 +104,48 @@ func TestDocumentString(t *testing.T) {
 	}
 }
 
+func TestBillStringDocuments(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:  isodate("2016-02-12"),
+				Payee: "IKEA",
+				Postings: []Posting{
+					Posting{Account: "Liabilities:CreditCard", Amount: dec("-55.95"), Currency: "EUR"},
+					Posting{Account: "Expenses:Home"},
+				},
+			},
+		},
+		Documents: []Document{
+			Document{Filename: "receipt.jpg"},
+			Document{Filename: "invoice.pdf", Date: isodate("2016-02-20"), Account: "Expenses:Home"},
+		},
+	}
+
+	expect := `2016-02-12 document Liabilities:CreditCard "receipt.jpg"`
+	if !s.Contains(bill.String(), expect) {
+		t.Errorf("hey: %s", bill.String())
+	}
+	expect = `2016-02-20 document Expenses:Home "invoice.pdf"`
+	if !s.Contains(bill.String(), expect) {
+		t.Errorf("hey: %s", bill.String())
+	}
+
+	c := conf{IncludesBeancountFile: "tmp/includes.beancount"}
+	text := c.inlineDocumentPaths("bills/2016/02/IKEA/bill.beancount", bill.String())
+	expect = `2016-02-12 document Liabilities:CreditCard "../bills/2016/02/IKEA/receipt.jpg"`
+	if !s.Contains(text, expect) {
+		t.Errorf("hey: %s", text)
+	}
+}
+
 func TestSanitizedBase(t *testing.T) {
 	txn := Transaction{
 		Date:      isodate("2016-02-12"),
 		Payee:     `Café de 'João'`,
 		Narration: `dois "X" café por cabeça`,
 		Postings: []Posting{
-			Posting{Account: "Assets:Bank:Checking", Amount: -5.50, Currency: "EUR"},
+			Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
 			Posting{Account: "Expenses:Coffee"},
 		},
 	}
@@ -116,7 +161,7 @@ func TestSanitizedBase(t *testing.T) {
 		Date:      isodate("2016-02-12"),
 		Narration: `dois "X" café por cabeça`,
 		Postings: []Posting{
-			Posting{Account: "Assets:Bank:Checking", Amount: -5.50, Currency: "EUR"},
+			Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
 			Posting{Account: "Expenses:Coffee"},
 		},
 	}
@@ -129,39 +174,46 @@ func TestSanitizedBase(t *testing.T) {
 	}
 }
 
-func TestTransactionSave(t *testing.T) {
-	transaction := Transaction{
-		Date:      isodate("2016-02-12"),
-		Payee:     `Café de 'João'`,
-		Narration: `dois "X" café por cabeça`,
-		Tags:      []string{"coffee", "portugal"},
-		Link:      "holiday-2016",
-		Postings: []Posting{
-			Posting{Account: "Assets:Bank:Checking", Amount: -5.50, Currency: "EUR"},
-			Posting{Account: "Expenses:Coffee"},
+func TestBillSave(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Payee:     `Café de 'João'`,
+				Narration: `dois "X" café por cabeça`,
+				Tags:      []string{"#coffee", "#portugal"},
+				Links:     []string{"^holiday-2016"},
+				Postings: []Posting{
+					Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+					Posting{Account: "Expenses:Coffee"},
+				},
+			},
 		},
-		Documents: []TxnDocument{
-			TxnDocument{Filename: "bill-one.png"},
-			TxnDocument{Filename: "bill-two.jpg"},
-			TxnDocument{Filename: "some-doc.pdf"},
+		Documents: []Document{
+			Document{Filename: "bill-one.png"},
+			Document{Filename: "bill-two.jpg"},
+			Document{Filename: "some-doc.pdf"},
 		},
 	}
 
-	appTempDir = "./testdata"
 	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
 	defer os.RemoveAll(config.BillsFolder)
 
-	transaction.Save(config)
+	bill.StagingDir = "./testdata"
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
 
 	// there should be a beancount file
-	path := filepath.Join(transaction.DirPath, transaction.BeancountFilename())
+	path := filepath.Join(bill.DirPath, bill.BeancountFilename())
 
 	text, err := ioutil.ReadFile(path)
 	if err != nil {
 		t.Errorf("hey: %v", err)
 	}
 
-	if string(text) != transaction.String() {
+	if string(text) != bill.String() {
 		t.Errorf("hey: %s", text)
 	}
 
@@ -169,18 +221,241 @@ func TestTransactionSave(t *testing.T) {
 
 	count := 0
 
-	for _, doc := range transaction.Documents {
-		f, err := os.Open(filepath.Join(transaction.DirPath, doc.Filename))
-		defer f.Close()
+	for _, doc := range bill.Documents {
+		f, err := os.Open(filepath.Join(bill.DirPath, doc.Filename))
 		if err != nil {
 			t.Errorf("hey: %v", err)
 			break
 		}
+		f.Close()
 		count++
 	}
 
-	if count != len(transaction.Documents) {
-		t.Errorf("hey: only %d out of %d documents were saved", count, len(transaction.Documents))
+	if count != len(bill.Documents) {
+		t.Errorf("hey: only %d out of %d documents were saved", count, len(bill.Documents))
+	}
+}
+
+func TestBillSaveRollback(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:  isodate("2016-02-12"),
+				Payee: "IKEA",
+				Postings: []Posting{
+					Posting{Account: "Assets:Bank:Checking", Amount: dec("-55.95"), Currency: "EUR"},
+					Posting{Account: "Expenses:Home"},
+				},
+			},
+		},
+		Documents: []Document{
+			Document{Filename: "bill-one.png"},
+			// not uploaded, the copy fails after the first document
+			Document{Filename: "missing.pdf"},
+		},
+		StagingDir: "./testdata",
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	err := bill.Save(config)
+	if status, _ := errorStatus(err); status != http.StatusBadRequest {
+		t.Fatalf("hey: saved with a missing document: %v", err)
+	}
+
+	if ex, _ := exists(config.BillsFolder); ex {
+		t.Errorf("hey: %s was left behind", config.BillsFolder)
+	}
+
+	// the retry is not refused with "Already exists"
+	bill.Documents = bill.Documents[:1]
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	files, _ := ioutil.ReadDir(config.BillsFolder)
+	for _, f := range files {
+		if s.HasPrefix(f.Name(), saveStagingPrefix) {
+			t.Errorf("hey: %s was left behind", f.Name())
+		}
+	}
+
+	if ex, _ := exists(filepath.Join(bill.DirPath, "bill-one.png")); !ex {
+		t.Errorf("hey: no document in %s", bill.DirPath)
+	}
+
+	err = bill.SaveDocuments()
+	if status, _ := errorStatus(err); status != http.StatusConflict {
+		t.Errorf("hey: copied over a document: %v", err)
+	}
+}
+
+func TestBillSaveCollision(t *testing.T) {
+	coffee := func() Bill {
+		return Bill{
+			Transactions: []Transaction{
+				Transaction{
+					Date:      isodate("2016-02-12"),
+					Payee:     "Café",
+					Narration: "Coffee",
+					Postings: []Posting{
+						Posting{Account: "Assets:Cash", Amount: dec("-2.50"), Currency: "EUR"},
+						Posting{Account: "Expenses:Coffee"},
+					},
+				},
+			},
+		}
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	var dirPaths []string
+	for i := 0; i < 3; i++ {
+		bill := coffee()
+		if err := bill.Save(config); err != nil {
+			t.Fatalf("hey: %v", err)
+		}
+		dirPaths = append(dirPaths, filepath.Base(bill.DirPath))
+	}
+
+	expect := []string{
+		"2016-02-12 _ Café _ Coffee _ €2.50",
+		"2016-02-12 _ Café _ Coffee _ €2.50 _ 2",
+		"2016-02-12 _ Café _ Coffee _ €2.50 _ 3",
+	}
+	for i := range expect {
+		if dirPaths[i] != expect[i] {
+			t.Errorf("hey: %s", dirPaths[i])
+		}
+	}
+
+	// editing the second one keeps its folder
+	second := filepath.Join(config.BillsFolder, "2016", "02", expect[1])
+	bill := coffee()
+	if err := bill.Update(config, second); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if bill.DirPath != second {
+		t.Errorf("hey: moved to %s", bill.DirPath)
+	}
+
+	// saved at the same time, each gets its own folder
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bill := coffee()
+			errs <- bill.Save(config)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("hey: %v", err)
+		}
+	}
+	if paths := config.billFilePaths(); len(paths) != 11 {
+		t.Errorf("hey: %v", paths)
+	}
+
+	// the conf given, not the global one
+	c := config
+	c.BillFolderTemplate = "{{.Payee}}"
+	bill = coffee()
+	if err := bill.Save(c); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if expect := filepath.Join("testbills", "Café", expect[0]); bill.DirPath != expect {
+		t.Errorf("hey: %s", bill.DirPath)
+	}
+}
+
+func TestAuxiliaryBillToBill(t *testing.T) {
+	aux := auxiliary_bill{
+		Transactions: []auxiliary_transaction{
+			auxiliary_transaction{
+				Date: "2016-02-12",
+				Postings: []auxiliary_posting{
+					auxiliary_posting{Account: "Expenses:Coffee", Amount: "5.50", Currency: "EUR"},
+					auxiliary_posting{Account: "Assets:Cash", Amount: "", Currency: "EUR"},
+				},
+			},
+		},
+		Balances: []auxiliary_balance{
+			auxiliary_balance{Date: "2016-02-13T00:00:00Z", Amount: "0", Currency: "EUR", SourceAccount: "Assets:Cash"},
+		},
+		Documents: []auxiliary_document{
+			auxiliary_document{Filename: "bill-one.png"},
+		},
+	}
+
+	bill, err := aux.ToBill(inputLocale{})
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if !bill.Transactions[0].Date.Equal(isodate("2016-02-12")) || !bill.Balances[0].Date.Equal(isodate("2016-02-13")) ||
+		!bill.Transactions[0].Postings[1].Amount.IsZero() || !bill.Documents[0].Date.IsZero() {
+		t.Errorf("hey: %v", bill)
+	}
+
+	aux.Transactions[0].Date = "12.02.2016"
+	aux.Transactions[0].Postings[0].Amount = "5,5O"
+	aux.Balances[0].Date = ""
+	aux.Balances[0].Amount = ""
+	aux.Notes = []auxiliary_note{auxiliary_note{Date: "2016-02", Account: "Assets:Cash"}}
+
+	_, err = aux.ToBill(inputLocale{})
+	verr, ok := err.(validationError)
+	if !ok {
+		t.Fatalf("hey: %v", err)
+	}
+
+	var fields []string
+	for _, f := range verr.Fields {
+		fields = append(fields, f.Field)
+	}
+	expect := "transactions[0].date transactions[0].postings[0].amount balances[0].date balances[0].amount notes[0].date"
+	if res := s.Join(fields, " "); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	errs := map[int]error{
+		http.StatusBadRequest:          badRequest(errors.New("bad")),
+		http.StatusConflict:            conflict(errors.New("exists")),
+		http.StatusMethodNotAllowed:    methodNotAllowed(errors.New("GET /save-bill")),
+		http.StatusUnprocessableEntity: validationError{Fields: []fieldError{fieldError{Field: "notes[0].account", Message: "Account is missing"}}},
+		http.StatusInternalServerError: errors.New("disk full"),
+	}
+
+	for status, err := range errs {
+		w := httptest.NewRecorder()
+		sendError(w, err)
+		if w.Code != status {
+			t.Errorf("hey: %d for %v", w.Code, err)
+		}
+
+		var body struct {
+			Error apiError `json:"error"`
+			Flash string   `json:"flash"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatalf("hey: %v", err)
+		}
+		if body.Error.Message != err.Error() || body.Flash != err.Error() || len(body.Error.Code) == 0 {
+			t.Errorf("hey: %v", body)
+		}
+		if status == http.StatusUnprocessableEntity && (len(body.Error.Fields) != 1 || body.Error.Fields[0].Field != "notes[0].account") {
+			t.Errorf("hey: %v", body)
+		}
 	}
 }
 
@@ -199,7 +474,7 @@ Expenses:Coffee`
 		txn.Narration != "dois 'X' café por cabeça",
 		txn.Tags[0] != "#coffee",
 		txn.Tags[1] != "#portugal",
-		txn.Link != "^holiday-2016":
+		txn.Links[0] != "^holiday-2016":
 		t.Errorf("hey: %v", txn)
 	}
 
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	s "strings"
+)
+
+// Decimal is an exact fixed-point number: coef * 10^-scale.
+//
+// Amounts keep the number of decimal places they were typed with, so that
+// "5.50" is rendered as "5.50" and "0.125" as "0.125", never as a float
+// approximation. The zero value is 0.
+//
+// Compare values with Cmp, not with ==.
+type Decimal struct {
+	coef  *big.Int
+	scale int
+}
+
+var decimalRe = regexp.MustCompile(`^([+-])?([0-9]+)(?:\.([0-9]*))?$|^([+-])?\.([0-9]+)$`)
+
+// ParseDecimal parses a plain decimal number such as "-5.50", "1000" or
+// ".5". Thousands separators and exponents are not accepted.
+func ParseDecimal(text string) (Decimal, error) {
+	text = s.TrimSpace(text)
+	m := decimalRe.FindStringSubmatch(text)
+	if m == nil {
+		return Decimal{}, errors.New(fmt.Sprintf("Not a decimal number: %q", text))
+	}
+
+	var sign, intPart, fracPart string
+	if len(m[2]) > 0 {
+		sign, intPart, fracPart = m[1], m[2], m[3]
+	} else {
+		sign, intPart, fracPart = m[4], "0", m[5]
+	}
+
+	coef, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok {
+		return Decimal{}, errors.New(fmt.Sprintf("Not a decimal number: %q", text))
+	}
+	if sign == "-" {
+		coef.Neg(coef)
+	}
+
+	return Decimal{coef: coef, scale: len(fracPart)}, nil
+}
+
+// MustDecimal is like ParseDecimal but panics on error. Meant for constants.
+func MustDecimal(text string) Decimal {
+	d, err := ParseDecimal(text)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) bigCoef() *big.Int {
+	if d.coef == nil {
+		return new(big.Int)
+	}
+	return d.coef
+}
+
+// Scale is the number of decimal places.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+func (d Decimal) IsZero() bool {
+	return d.bigCoef().Sign() == 0
+}
+
+// Sign returns -1, 0 or +1.
+func (d Decimal) Sign() int {
+	return d.bigCoef().Sign()
+}
+
+func (d Decimal) Neg() Decimal {
+	return Decimal{coef: new(big.Int).Neg(d.bigCoef()), scale: d.scale}
+}
+
+func (d Decimal) Abs() Decimal {
+	return Decimal{coef: new(big.Int).Abs(d.bigCoef()), scale: d.scale}
+}
+
+// rescale returns the same value with more decimal places. It never drops
+// digits, a smaller scale than the current one is ignored.
+func (d Decimal) rescale(scale int) Decimal {
+	if scale <= d.scale {
+		return d
+	}
+	mul := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-d.scale)), nil)
+	return Decimal{coef: new(big.Int).Mul(d.bigCoef(), mul), scale: scale}
+}
+
+func (d Decimal) Add(o Decimal) Decimal {
+	scale := d.scale
+	if o.scale > scale {
+		scale = o.scale
+	}
+	a, b := d.rescale(scale), o.rescale(scale)
+	return Decimal{coef: new(big.Int).Add(a.bigCoef(), b.bigCoef()), scale: scale}
+}
+
+func (d Decimal) Sub(o Decimal) Decimal {
+	return d.Add(o.Neg())
+}
+
+func (d Decimal) Mul(o Decimal) Decimal {
+	return Decimal{coef: new(big.Int).Mul(d.bigCoef(), o.bigCoef()), scale: d.scale + o.scale}
+}
+
+// Cmp returns -1, 0 or +1 as d is less than, equal to or greater than o.
+func (d Decimal) Cmp(o Decimal) int {
+	scale := d.scale
+	if o.scale > scale {
+		scale = o.scale
+	}
+	return d.rescale(scale).bigCoef().Cmp(o.rescale(scale).bigCoef())
+}
+
+// String renders the value exactly, with the places it was typed with.
+func (d Decimal) String() string {
+	return d.Format(0)
+}
+
+// Format renders the value with at least minPlaces decimal places. Places
+// beyond the typed ones are padded with zeros, typed places are never
+// rounded away.
+func (d Decimal) Format(minPlaces int) string {
+	d = d.rescale(minPlaces)
+
+	digits := new(big.Int).Abs(d.bigCoef()).String()
+	if d.scale > 0 {
+		for len(digits) <= d.scale {
+			digits = "0" + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+
+	if d.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// FormatCurrency renders the value with the precision of the currency.
+func (d Decimal) FormatCurrency(currency string) string {
+	return d.Format(config.currencyPrecision(currency))
+}
+
+// Amounts are encoded as JSON strings to keep them exact.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Accepts both JSON strings and numbers. An empty string is zero.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := s.Trim(string(data), `"`)
+	if len(text) == 0 || text == "null" {
+		*d = Decimal{}
+		return nil
+	}
+	v, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// Decimal places of currencies which don't use two. The config can add to or
+// override these with currency_precision.
+var currencyPrecisions = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"IQD": 3,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"PYG": 0,
+	"TND": 3,
+	"UGX": 0,
+	"VND": 0,
+}
+
+// Uses globals: currencyPrecisions
+func (c conf) currencyPrecision(currency string) int {
+	if p, ok := c.CurrencyPrecision[currency]; ok {
+		return p
+	}
+	if p, ok := currencyPrecisions[currency]; ok {
+		return p
+	}
+	return 2
+}
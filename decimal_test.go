@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecimalRoundTrip(t *testing.T) {
+	for _, text := range []string{"5.50", "-5.50", "0.125", "1000", "0.00", "-0.05", "12345678901234567890.123456789"} {
+		d, err := ParseDecimal(text)
+		if err != nil {
+			t.Errorf("hey: %v", err)
+			continue
+		}
+		if d.String() != text {
+			t.Errorf("hey: %s != %s", d.String(), text)
+		}
+	}
+
+	for _, text := range []string{"", "1,5", "1.2.3", "abc", "1e5", "--1"} {
+		if _, err := ParseDecimal(text); err == nil {
+			t.Errorf("hey: %q should not parse", text)
+		}
+	}
+}
+
+func TestDecimalArithmetic(t *testing.T) {
+	// the float64 sum of these is 0.30000000000000004
+	sum := dec("0.1").Add(dec("0.2"))
+	if sum.Cmp(dec("0.3")) != 0 || sum.String() != "0.3" {
+		t.Errorf("hey: %s", sum)
+	}
+
+	sum = dec("-5.50").Add(dec("2.5")).Add(dec("3"))
+	if !sum.IsZero() {
+		t.Errorf("hey: %s", sum)
+	}
+
+	if res := dec("-5.5").Abs().Format(2); res != "5.50" {
+		t.Errorf("hey: %s", res)
+	}
+
+	if res := dec("2.5").Mul(dec("1.1")).String(); res != "2.75" {
+		t.Errorf("hey: %s", res)
+	}
+}
+
+func TestDecimalFormatCurrency(t *testing.T) {
+	config.CurrencyPrecision = map[string]int{"BTC": 8}
+	defer func() { config.CurrencyPrecision = nil }()
+
+	var amounts = map[string]string{
+		"EUR": "5.50",
+		"JPY": "5.5",
+		"KWD": "5.500",
+		"BTC": "5.50000000",
+	}
+
+	for currency, expect := range amounts {
+		res := dec("5.5").FormatCurrency(currency)
+		if res != expect {
+			t.Errorf("hey: %s %s", res, currency)
+		}
+	}
+}
+
+func TestDecimalJSON(t *testing.T) {
+	var p Posting
+	if err := json.Unmarshal([]byte(`{"account": "Expenses:Coffee", "amount": "0.10"}`), &p); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if p.Amount.String() != "0.10" {
+		t.Errorf("hey: %s", p.Amount)
+	}
+
+	out, _ := json.Marshal(p.Amount)
+	if string(out) != `"0.10"` {
+		t.Errorf("hey: %s", out)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	s "strings"
+	"time"
+	"unicode"
+)
+
+// Before a bill is saved, the saved bills are searched for likely duplicates
+// of it: a transaction with the same amount, a similar payee and a date no
+// more than duplicate_days apart, or a document with the same content. The
+// bill is only saved with allow_duplicates when there are any.
+
+type duplicate struct {
+	DirPath string `json:"dir_path"`
+	Reason  string `json:"reason"`
+}
+
+// duplicatesError is returned instead of saving, the client can save again
+// with allow_duplicates.
+type duplicatesError struct {
+	Duplicates []duplicate
+}
+
+func (e duplicatesError) Error() string {
+	var dirPaths []string
+	for _, d := range e.Duplicates {
+		dirPaths = append(dirPaths, filepath.Base(d.DirPath))
+	}
+	return fmt.Sprintf("Possible duplicate of: %s", s.Join(dirPaths, ", "))
+}
+
+func (c conf) duplicateDays() int {
+	if c.DuplicateDays < 0 {
+		return 0
+	}
+	return c.DuplicateDays
+}
+
+type postingAmount struct {
+	amount   Decimal
+	currency string
+}
+
+// postingAmounts are the amounts of the postings, without the sign. The two
+// sides of a transaction have the same amount, so a transaction with an
+// elided posting compares the same.
+func postingAmounts(txn Transaction) []postingAmount {
+	var amounts []postingAmount
+	for _, p := range txn.Postings {
+		if p.Amount.IsZero() || len(p.Currency) == 0 {
+			continue
+		}
+		amounts = append(amounts, postingAmount{amount: p.Amount.Abs(), currency: p.Currency})
+	}
+	return amounts
+}
+
+// sharedAmount compares the amounts as numbers, 5.5 EUR is 5.500 EUR.
+func sharedAmount(a Transaction, b Transaction) bool {
+	for _, x := range postingAmounts(a) {
+		for _, y := range postingAmounts(b) {
+			if x.currency == y.currency && x.amount.Cmp(y.amount) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nameWords(text string) []string {
+	return s.FieldsFunc(s.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// similarNames compares payees such as "IKEA" and "IKEA DEUTSCHLAND GMBH
+// 1234" from a statement: one containing the other, or a shared word of three
+// letters or more. An empty name is similar to anything, it says nothing.
+func similarNames(a string, b string) bool {
+	wa, wb := nameWords(a), nameWords(b)
+	if len(wa) == 0 || len(wb) == 0 {
+		return true
+	}
+
+	ja, jb := s.Join(wa, " "), s.Join(wb, " ")
+	if s.Contains(ja, jb) || s.Contains(jb, ja) {
+		return true
+	}
+
+	words := make(map[string]bool)
+	for _, w := range wa {
+		if len([]rune(w)) >= 3 {
+			words[w] = true
+		}
+	}
+	for _, w := range wb {
+		if words[w] {
+			return true
+		}
+	}
+	return false
+}
+
+func similarTransactions(a Transaction, b Transaction, days int) bool {
+	diff := a.Date.Sub(b.Date)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > time.Duration(days)*24*time.Hour {
+		return false
+	}
+
+	// two bank transactions
+	fa, fb := a.Meta.Get("fitid"), b.Meta.Get("fitid")
+	if len(fa) > 0 && len(fb) > 0 && fa != fb {
+		return false
+	}
+
+	if !sharedAmount(a, b) {
+		return false
+	}
+
+	payeeA, payeeB := a.Payee, b.Payee
+	if len(payeeA) == 0 {
+		payeeA = a.Narration
+	}
+	if len(payeeB) == 0 {
+		payeeB = b.Narration
+	}
+	return similarNames(payeeA, payeeB)
+}
+
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// documentFile is an uploaded document of a bill being saved.
+type documentFile struct {
+	filename string
+	size     int64
+	hash     string
+}
+
+// stagedDocuments hashes the documents waiting in the staging folder.
+func (b Bill) stagedDocuments() []documentFile {
+	var docs []documentFile
+	for _, doc := range b.Documents {
+		if len(doc.Filename) == 0 || validateFilename(doc.Filename) != nil {
+			continue
+		}
+		path := filepath.Join(b.StagingDir, doc.Filename)
+		f, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		hash, err := fileHash(path)
+		if err != nil {
+			continue
+		}
+		docs = append(docs, documentFile{filename: doc.Filename, size: f.Size(), hash: hash})
+	}
+	return docs
+}
+
+// findDuplicates compares the bill with the saved bills. except is the
+// folder of the bill itself when it is edited.
+func (c conf) findDuplicates(b Bill, saved []billEntry, except string) []duplicate {
+	dups := []duplicate{}
+	docs := b.stagedDocuments()
+
+	for _, entry := range saved {
+		if len(except) > 0 && filepath.Clean(entry.DirPath) == filepath.Clean(except) {
+			continue
+		}
+
+		reason := ""
+
+	txns:
+		for _, txn := range b.Transactions {
+			for _, other := range entry.Bill.Transactions {
+				if similarTransactions(txn, other, c.duplicateDays()) {
+					reason = fmt.Sprintf("Similar transaction on %s", other.Date.Format("2006-01-02"))
+					break txns
+				}
+			}
+		}
+
+		// only files of the same size are hashed
+		for _, doc := range docs {
+			if len(reason) > 0 {
+				break
+			}
+			for _, f := range entry.Documents {
+				if f.Size != doc.size {
+					continue
+				}
+				if hash, err := fileHash(filepath.Join(entry.DirPath, f.Filename)); err == nil && hash == doc.hash {
+					reason = fmt.Sprintf("Same document as %s", f.Filename)
+					break
+				}
+			}
+		}
+
+		if len(reason) > 0 {
+			dups = append(dups, duplicate{DirPath: entry.DirPath, Reason: reason})
+		}
+	}
+
+	return dups
+}
+
+// checkDuplicates returns a duplicatesError when the bill looks like one of
+// the saved bills.
+func (c conf) checkDuplicates(b Bill, except string) error {
+	dups := c.findDuplicates(b, c.listBills(billFilter{}), except)
+	if len(dups) > 0 {
+		return duplicatesError{Duplicates: dups}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	s "strings"
+	"testing"
+)
+
+func TestSimilarNames(t *testing.T) {
+	similar := [][]string{
+		{"IKEA", "IKEA DEUTSCHLAND GMBH 1234"},
+		{"Café João", "cafe joão lisboa"},
+		{"", "anything"},
+		{"Lidl Berlin", "LIDL SAGT DANKE"},
+	}
+	for _, names := range similar {
+		if !similarNames(names[0], names[1]) {
+			t.Errorf("hey: not similar: %q %q", names[0], names[1])
+		}
+	}
+
+	if similarNames("Bakery", "Butcher") {
+		t.Errorf("hey: Bakery and Butcher are similar")
+	}
+	if similarNames("DB", "DM drogerie") {
+		t.Errorf("hey: short words are similar")
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	receipt := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Payee:     "IKEA",
+				Narration: "shelves",
+				Postings: []Posting{
+					Posting{Account: "Expenses:Home", Amount: dec("55.95"), Currency: "EUR"},
+					Posting{Account: "Assets:Bank:Checking"},
+				},
+			},
+		},
+		Documents: []Document{
+			Document{Filename: "bill-one.png"},
+		},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.DuplicateDays = 3
+	defer os.RemoveAll(config.BillsFolder)
+
+	receipt.StagingDir = "./testdata"
+	if err := receipt.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	saved := config.listBills(billFilter{})
+
+	// the statement line two days later
+	line := importedBill(isodate("2016-02-14"), "Assets:Bank:Checking", dec("-55.95"), "EUR", "IKEA DEUTSCHLAND GMBH", "", "TX1")
+	dups := config.findDuplicates(line, saved, "")
+	if len(dups) != 1 || dups[0].DirPath != receipt.DirPath {
+		t.Errorf("hey: %v", dups)
+	}
+
+	if dups = config.findDuplicates(line, saved, receipt.DirPath); len(dups) != 0 {
+		t.Errorf("hey: the bill itself is a duplicate: %v", dups)
+	}
+
+	// the same amount written with more places
+	precise := importedBill(isodate("2016-02-13"), "Assets:Bank:Checking", dec("-55.950"), "EUR", "IKEA", "", "TX4")
+	if dups = config.findDuplicates(precise, saved, ""); len(dups) != 1 {
+		t.Errorf("hey: %v", dups)
+	}
+
+	later := importedBill(isodate("2016-02-20"), "Assets:Bank:Checking", dec("-55.95"), "EUR", "IKEA DEUTSCHLAND GMBH", "", "TX2")
+	if dups = config.findDuplicates(later, saved, ""); len(dups) != 0 {
+		t.Errorf("hey: %v", dups)
+	}
+
+	other := importedBill(isodate("2016-02-12"), "Assets:Bank:Checking", dec("-55.95"), "EUR", "Bakery", "", "TX3")
+	if dups = config.findDuplicates(other, saved, ""); len(dups) != 0 {
+		t.Errorf("hey: %v", dups)
+	}
+
+	// the same scan entered again with another date
+	scan := Bill{
+		Notes:      []Note{Note{Date: isodate("2016-03-01"), Account: "Expenses:Home", Description: "warranty"}},
+		Documents:  []Document{Document{Filename: "bill-one.png"}},
+		StagingDir: "./testdata",
+	}
+	if dups = config.findDuplicates(scan, saved, ""); len(dups) != 1 || dups[0].Reason != "Same document as bill-one.png" {
+		t.Errorf("hey: %v", dups)
+	}
+
+	if err := config.checkDuplicates(line, ""); err == nil {
+		t.Errorf("hey: no duplicatesError")
+	}
+
+	res, err := config.saveImported([]Bill{line, later}, false)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(res.DirPaths) != 1 || len(res.Skipped) != 1 || res.Skipped[0].Entry != 1 ||
+		res.Skipped[0].Reason != skippedDuplicate || len(res.Skipped[0].Duplicates) != 1 {
+		t.Errorf("hey: %v", res)
+	}
+	if msg := res.Skipped[0].String(); !s.HasPrefix(msg, "Entry 1, 2016-02-14 _ IKEA") || !s.Contains(msg, "possible duplicate of") {
+		t.Errorf("hey: %s", msg)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	s "strings"
+	"sync"
+)
+
+// Edits of the same bill wait for each other. The locks are keyed by the
+// absolute folder path, and dropped when nobody holds or waits for them.
+type billLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+var billLocks = struct {
+	mu    sync.Mutex
+	locks map[string]*billLock
+}{locks: make(map[string]*billLock)}
+
+// lockBill waits for the other edits of the bill in dirPath, and returns the
+// function which lets the next one in.
+func lockBill(dirPath string) func() {
+	key, err := filepath.Abs(dirPath)
+	if err != nil {
+		key = filepath.Clean(dirPath)
+	}
+
+	billLocks.mu.Lock()
+	l, ok := billLocks.locks[key]
+	if !ok {
+		l = &billLock{}
+		billLocks.locks[key] = l
+	}
+	l.users++
+	billLocks.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+		billLocks.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(billLocks.locks, key)
+		}
+		billLocks.mu.Unlock()
+	}
+}
+
+// lockedBillDirPath checks the folder as billDirPath, and holds the lock of
+// the bill. A bill moved or trashed while waiting is not found.
+func (c conf) lockedBillDirPath(dirPath string) (string, func(), error) {
+	dirPath, err := c.billDirPath(dirPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	unlock := lockBill(dirPath)
+
+	if ex, _ := exists(filepath.Join(dirPath, Bill{}.BeancountFilename())); !ex {
+		unlock()
+		return "", nil, notFound(errors.New(fmt.Sprintf("The bill was moved or deleted: %s", dirPath)))
+	}
+
+	return dirPath, unlock, nil
+}
+
+// billDirPath checks that a folder path sent by a client, as it was returned
+// in dir_path when saving, is a bill folder inside the bills folder.
+func (c conf) billDirPath(dirPath string) (string, error) {
+	notBill := badRequest(errors.New(fmt.Sprintf("Not a bill folder: %s", dirPath)))
+
+	if len(dirPath) == 0 {
+		return "", notBill
+	}
+
+	absBills, err := filepath.Abs(c.BillsFolder)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(dirPath)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(absBills, absDir)
+	if err != nil || rel == "." {
+		return "", notBill
+	}
+	// outside of the bills folder, or in a hidden folder such as the staging
+	// folders of bills being saved
+	for _, segment := range s.Split(rel, string(filepath.Separator)) {
+		if s.HasPrefix(segment, ".") {
+			return "", notBill
+		}
+	}
+
+	dirPath = filepath.Join(c.BillsFolder, rel)
+
+	if ex, _ := exists(filepath.Join(dirPath, Bill{}.BeancountFilename())); !ex {
+		return "", notBill
+	}
+
+	return dirPath, nil
+}
+
+// LoadBill reads a saved bill folder back into a Bill. Files in the folder
+// without a document directive are added as documents with only a filename.
+func LoadBill(dirPath string) (Bill, error) {
+	bill := Bill{DirPath: dirPath}
+
+	ledger, err := ParseBeancountFile(filepath.Join(dirPath, bill.BeancountFilename()))
+	if err != nil {
+		return bill, err
+	}
+
+	// Saving the bill again would drop these.
+	if len(ledger.Pads) > 0 || len(ledger.Opens) > 0 || len(ledger.Closes) > 0 ||
+		len(ledger.Prices) > 0 || len(ledger.Commodities) > 0 ||
+		len(ledger.Options) > 0 || len(ledger.Includes) > 0 {
+		return bill, conflict(errors.New(fmt.Sprintf("Has directives a bill can't hold: %s", dirPath)))
+	}
+
+	bill.Transactions = ledger.Transactions
+	bill.Balances = ledger.Balances
+	bill.Notes = ledger.Notes
+	bill.Documents = ledger.Documents
+
+	known := make(map[string]bool)
+	for _, doc := range bill.Documents {
+		known[doc.Filename] = true
+	}
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return bill, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || f.Name() == bill.BeancountFilename() || s.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if !known[f.Name()] {
+			bill.Documents = append(bill.Documents, Document{Filename: f.Name()})
+		}
+	}
+
+	return bill, nil
+}
+
+// removeEmptyDirs removes dir and its parents while they are empty, up to but
+// not including stop.
+func removeEmptyDirs(dir string, stop string) {
+	absStop, err := filepath.Abs(stop)
+	if err != nil {
+		return
+	}
+
+	for {
+		absDir, err := filepath.Abs(dir)
+		if err != nil || !s.HasPrefix(absDir, absStop+string(filepath.Separator)) {
+			return
+		}
+		// fails when not empty
+		if err = os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Update rewrites the beancount file of the bill saved in oldDirPath, and
+// moves the folder when the date, payee or narration changed. A suffix is
+// added when the new folder is taken, as when saving.
+//
+// Documents which are not in the folder yet are copied from the staging
+// folder. An upload named as a file already in the folder is a conflict.
+// Files which are no longer listed are left in the folder.
+//
+// When a step fails, the copied documents are removed, the beancount file is
+// written back and the folder is moved back, the bill is as before.
+//
+// Uses globals: config
+func (b *Bill) Update(c conf, oldDirPath string) (err error) {
+	oldDirPath = filepath.Clean(oldDirPath)
+
+	newDirPath, err := c.layoutDirPath(*b)
+	if err != nil {
+		return err
+	}
+
+	if newDirPath, err = freeDirPath(newDirPath, oldDirPath); err != nil {
+		return err
+	}
+
+	moving := filepath.Clean(newDirPath) != oldDirPath
+
+	path := filepath.Join(oldDirPath, b.BeancountFilename())
+	oldText, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var copied []string
+	written := false
+	moved := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if moved {
+			os.MkdirAll(filepath.Dir(oldDirPath), 0755)
+			os.Rename(newDirPath, oldDirPath)
+		}
+		if moving {
+			removeEmptyDirs(filepath.Dir(newDirPath), c.BillsFolder)
+		}
+		if written {
+			writeFileAtomic(path, oldText)
+		}
+		for _, p := range copied {
+			os.Remove(p)
+		}
+		b.DirPath = oldDirPath
+		if moved {
+			c.updateIncludesBeancountFile()
+		}
+	}()
+
+	b.DirPath = oldDirPath
+
+	for _, doc := range b.Documents {
+		if len(doc.Filename) == 0 {
+			continue
+		}
+		if err = validateFilename(doc.Filename); err != nil {
+			return err
+		}
+		docPath := filepath.Join(oldDirPath, doc.Filename)
+		if ex, _ := exists(docPath); ex {
+			if staged, _ := exists(filepath.Join(b.StagingDir, doc.Filename)); staged && len(b.StagingDir) > 0 {
+				err = conflict(errors.New(fmt.Sprintf("The bill already has a document named %s, rename the upload", doc.Filename)))
+				return err
+			}
+			continue
+		}
+		if err = doc.Copy(b.StagingDir, docPath); err != nil {
+			os.Remove(docPath)
+			return err
+		}
+		copied = append(copied, docPath)
+	}
+
+	if err = writeFileAtomic(path, []byte(b.String())); err != nil {
+		return err
+	}
+	written = true
+
+	if moving {
+		if err = os.MkdirAll(filepath.Dir(newDirPath), 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(oldDirPath, newDirPath); err != nil {
+			return err
+		}
+		moved = true
+		b.DirPath = newDirPath
+		removeEmptyDirs(filepath.Dir(oldDirPath), c.BillsFolder)
+	}
+
+	if err = c.updateIncludesBeancountFile(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Uses globals: config
+func billHandler(w http.ResponseWriter, r *http.Request) {
+	dirPath, err := config.billDirPath(r.URL.Query().Get("dir_path"))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	bill, err := LoadBill(dirPath)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(bill)
+}
+
+// Uses globals: config, staging
+func updateBillHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+
+	var aux_bill auxiliary_bill
+
+	if err := decoder.Decode(&aux_bill); err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
+
+	bill, err := aux_bill.ToBill(config.InputLocale)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	dirPath, unlock, err := config.lockedBillDirPath(aux_bill.DirPath)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	defer unlock()
+
+	area, err := staging.area(draftID(w, r, aux_bill.DraftID))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	area.mu.Lock()
+	defer area.mu.Unlock()
+
+	bill.StagingDir = area.dir
+
+	if err := config.checkBill(bill); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	if !aux_bill.AllowDuplicates {
+		if err := config.checkDuplicates(bill, dirPath); err != nil {
+			sendError(w, err)
+			return
+		}
+	}
+
+	if err := bill.Update(config, dirPath); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	area.clear()
+
+	sendSavedBill(w, bill)
+}
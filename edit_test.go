@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBillUpdate(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Payee:     "Cafe Jao",
+				Narration: "coffee",
+				Tags:      []string{"#coffee"},
+				Postings: []Posting{
+					Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+					Posting{Account: "Expenses:Coffee"},
+				},
+			},
+		},
+		Documents: []Document{
+			Document{Filename: "bill-one.png"},
+		},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	bill.StagingDir = "./testdata"
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	oldDirPath := bill.DirPath
+
+	if _, err := config.billDirPath("./testbills/../testdata"); err == nil {
+		t.Errorf("hey: testdata is not a bill folder")
+	}
+
+	dirPath, err := config.billDirPath(oldDirPath)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	loaded, err := LoadBill(dirPath)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(loaded.Transactions) != 1 || loaded.Transactions[0].Payee != "Cafe Jao" ||
+		len(loaded.Documents) != 1 || loaded.Documents[0].Filename != "bill-one.png" {
+		t.Fatalf("hey: %v", loaded)
+	}
+
+	// fix a typo in the payee and add a document
+
+	loaded.Transactions[0].Payee = "Café João"
+	loaded.Documents = append(loaded.Documents, Document{Filename: "bill-two.jpg"})
+
+	// an upload named as a document of the bill
+	loaded.StagingDir = "./testdata"
+	err = loaded.Update(config, dirPath)
+	if status, _ := errorStatus(err); status != http.StatusConflict {
+		t.Fatalf("hey: %v", err)
+	}
+	if ex, _ := exists(filepath.Join(dirPath, "bill-two.jpg")); ex {
+		t.Errorf("hey: the other upload is left")
+	}
+
+	stagingDir, _ := ioutil.TempDir("", "bills_test")
+	defer os.RemoveAll(stagingDir)
+	content, _ := ioutil.ReadFile("./testdata/bill-two.jpg")
+	ioutil.WriteFile(filepath.Join(stagingDir, "bill-two.jpg"), content, 0644)
+
+	loaded.StagingDir = stagingDir
+	if err = loaded.Update(config, dirPath); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if ex, _ := exists(oldDirPath); ex {
+		t.Errorf("hey: old folder is still there: %s", oldDirPath)
+	}
+
+	expect := filepath.Join("testbills", "2016", "02", "2016-02-12 _ Café João _ coffee _ €5.50")
+	if loaded.DirPath != expect {
+		t.Errorf("hey: %s", loaded.DirPath)
+	}
+
+	text, err := ioutil.ReadFile(filepath.Join(loaded.DirPath, loaded.BeancountFilename()))
+	if err != nil || string(text) != loaded.String() {
+		t.Errorf("hey: %s %v", text, err)
+	}
+
+	for _, name := range []string{"bill-one.png", "bill-two.jpg"} {
+		if ex, _ := exists(filepath.Join(loaded.DirPath, name)); !ex {
+			t.Errorf("hey: missing %s", name)
+		}
+	}
+
+	// an edit which waited for this one finds the bill moved
+	if _, _, err := config.lockedBillDirPath(oldDirPath); err == nil {
+		t.Errorf("hey: the old folder is still a bill")
+	}
+}
+
+func TestLockBill(t *testing.T) {
+	unlock := lockBill("./testbills/a")
+
+	done := make(chan bool)
+	go func() {
+		unlockOther := lockBill("testbills/b/../a")
+		done <- true
+		unlockOther()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("hey: locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+	<-done
+
+	billLocks.mu.Lock()
+	defer billLocks.mu.Unlock()
+	if len(billLocks.locks) != 0 {
+		t.Errorf("hey: %v", billLocks.locks)
+	}
+}
+
+func TestBillUpdateRollsBack(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Payee:     "Cafe Jao",
+				Narration: "coffee",
+				Postings: []Posting{
+					Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+					Posting{Account: "Expenses:Coffee"},
+				},
+			},
+		},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	dirPath := bill.DirPath
+	path := filepath.Join(dirPath, bill.BeancountFilename())
+	oldText, _ := ioutil.ReadFile(path)
+
+	os.MkdirAll(filepath.Join(config.BillsFolder, ".b2b-save-x"), 0755)
+	ioutil.WriteFile(filepath.Join(config.BillsFolder, ".b2b-save-x", bill.BeancountFilename()), oldText, 0644)
+	if _, err := config.billDirPath(filepath.Join(config.BillsFolder, ".b2b-save-x")); err == nil {
+		t.Errorf("hey: a staging folder is not a bill folder")
+	}
+
+	// the new folder can't be made
+	ioutil.WriteFile(filepath.Join(config.BillsFolder, "2017"), []byte("x"), 0644)
+
+	edited := bill
+	edited.Transactions = []Transaction{bill.Transactions[0]}
+	edited.Transactions[0].Date = isodate("2017-01-05")
+	edited.Documents = []Document{Document{Filename: "bill-one.png"}}
+	edited.StagingDir = "./testdata"
+
+	if err := edited.Update(config, dirPath); err == nil {
+		t.Fatalf("hey: moved into a file")
+	}
+
+	if edited.DirPath != dirPath {
+		t.Errorf("hey: %s", edited.DirPath)
+	}
+	if text, _ := ioutil.ReadFile(path); string(text) != string(oldText) {
+		t.Errorf("hey: %s", text)
+	}
+	if ex, _ := exists(filepath.Join(dirPath, "bill-one.png")); ex {
+		t.Errorf("hey: the copied document is left")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"path/filepath"
+	"regexp"
+	s "strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Uploaded and saved documents are single files directly in the staging or
+// bill folder. Names from clients are checked here before they are joined
+// onto a folder path.
+
+// validateFilename rejects names which are not a plain file name, such as
+// "../x", "/etc/x", "a/b" or "C:x".
+func validateFilename(name string) error {
+	invalid := badRequest(errors.New(fmt.Sprintf("Invalid filename: %q", name)))
+
+	if len(name) == 0 || name == "." || name == ".." || s.HasPrefix(name, ".") {
+		return invalid
+	}
+	if s.ContainsAny(name, `/\:`) || filepath.IsAbs(name) || filepath.Base(name) != name {
+		return invalid
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return invalid
+		}
+	}
+
+	return nil
+}
+
+// cleanUploadFilename keeps only the last element of a client supplied path,
+// some browsers send the full path of the file, and then validates it. Names
+// are composed to NFC, macOS sends them decomposed.
+func cleanUploadFilename(name string) (string, error) {
+	if i := s.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = s.TrimSpace(norm.NFC.String(name))
+
+	if err := validateFilename(name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// checkDocumentFilenames validates every document before anything is written.
+func (b Bill) checkDocumentFilenames() error {
+	for _, doc := range b.Documents {
+		if len(doc.Filename) == 0 {
+			continue
+		}
+		if err := validateFilename(doc.Filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Folder names are made of the bill contents. They keep the letters, numbers
+// and currency symbols of any language, and the rest becomes spaces. They are
+// also safe on Windows and Dropbox: no reserved device names, no leading or
+// trailing dots and spaces, and not too long.
+//
+// The length is in bytes of UTF-8, as file systems count it, and can't be
+// more than their 255.
+
+const defaultFilenameMaxLength = 100
+const filesystemMaxLength = 255
+
+// room left in the length for the " _ 2" to " _ 999" of freeDirPath
+const dirSuffixRoom = len(" _ 999")
+
+var windowsReservedRe = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[0-9]|LPT[0-9])( *\..*)?$`)
+
+func (c conf) filenameMaxLength() int {
+	if c.FilenameMaxLength <= 0 {
+		return defaultFilenameMaxLength
+	}
+	if c.FilenameMaxLength > filesystemMaxLength {
+		return filesystemMaxLength
+	}
+	return c.FilenameMaxLength
+}
+
+// cutBytes cuts text to at most n bytes, back to where a character starts.
+func cutBytes(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+func filenameRuneAllowed(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r) ||
+		unicode.Is(unicode.Sc, r) || s.ContainsRune(`_.'-`, r)
+}
+
+// sanitizeFilename makes a folder name of text, "" when nothing is left of it.
+//
+// Uses globals: config
+func sanitizeFilename(text string) string {
+	var out []rune
+
+	for _, r := range norm.NFC.String(text) {
+		if !filenameRuneAllowed(r) || s.ContainsRune(config.FilenameForbiddenChars, r) {
+			r = ' '
+		}
+		if r == ' ' && len(out) > 0 && out[len(out)-1] == ' ' {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	// the cap comes last, with room for the suffix of a taken folder
+	limit := config.filenameMaxLength() - dirSuffixRoom
+	if limit < 1 {
+		limit = 1
+	}
+	capped := func(name string) string {
+		return s.Trim(cutBytes(name, limit), " .")
+	}
+
+	name := capped(string(out))
+
+	if windowsReservedRe.MatchString(name) {
+		name = capped("_" + name)
+	}
+
+	return name
+}
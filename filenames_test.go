@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"golang.org/x/text/unicode/norm"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestValidateFilename(t *testing.T) {
+	for _, name := range []string{"receipt.pdf", "2016-02-12 IKEA €55.95.jpg", "café.png"} {
+		if err := validateFilename(name); err != nil {
+			t.Errorf("hey: %v", err)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", "../x.pdf", "/etc/passwd", `..\x.pdf`, "a/b.pdf", "C:x.pdf", ".hidden", "x\x00.pdf"} {
+		if err := validateFilename(name); err == nil {
+			t.Errorf("hey: %q should be invalid", name)
+		}
+	}
+
+	var names = map[string]string{
+		`C:\Users\me\Scans\receipt.pdf`: "receipt.pdf",
+		"/home/me/receipt.pdf":          "receipt.pdf",
+		"receipt.pdf":                   "receipt.pdf",
+	}
+
+	for name, expect := range names {
+		if res, err := cleanUploadFilename(name); err != nil || res != expect {
+			t.Errorf("hey: %s %v", res, err)
+		}
+	}
+
+	if _, err := cleanUploadFilename("../.."); err == nil {
+		t.Errorf("hey: ../.. should be invalid")
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	names := map[string]string{
+		`Café de 'João' _ dois "X" café`:   `Café de 'João' _ dois X café`,
+		"Straße _ Łódź _ Gődöllő _ Ørsted": "Straße _ Łódź _ Gődöllő _ Ørsted",
+		"e\u0301clair":          "\u00e9clair",
+		"¥1200 ₹550.00 €5 $3":   "¥1200 ₹550.00 €5 $3",
+		"a/b\\c:d*e?f<g>h|i\tj": "a b c d e f g h i j",
+		"...hidden":             "hidden",
+		"ends with dots... ":    "ends with dots",
+		"con":                   "_con",
+		"LPT1.txt":              "_LPT1.txt",
+		"CONTOSO":               "CONTOSO",
+		"?*":                    "",
+		s.Repeat("ő", 150):      s.Repeat("ő", 47),
+	}
+
+	for text, expect := range names {
+		if res := sanitizeFilename(text); res != expect {
+			t.Errorf("hey: %q: %q", text, res)
+		}
+	}
+
+	config.FilenameForbiddenChars = "'$"
+	config.FilenameMaxLength = 13
+	defer func() {
+		config.FilenameForbiddenChars = ""
+		config.FilenameMaxLength = 0
+	}()
+
+	if res := sanitizeFilename("Joe's $5 dinner"); res != "Joe s 5" {
+		t.Errorf("hey: %q", res)
+	}
+
+	// cut again after the prefix
+	config.FilenameMaxLength = 10
+	if res := sanitizeFilename("LPT1.txt"); res != "_LPT" {
+		t.Errorf("hey: %q", res)
+	}
+
+	// with the suffix of a taken folder
+	if res := sanitizeFilename("2016-02-12 _ IKEA _ cupboard") + " _ 999"; len(res) > 10 {
+		t.Errorf("hey: %q", res)
+	}
+
+	// a long payee in a script of three bytes a letter, decomposed as well
+	config.FilenameMaxLength = 1000
+	txn := Transaction{
+		Date:      isodate("2016-02-12"),
+		Payee:     s.Repeat("東京", 60) + s.Repeat("e\u0301", 60),
+		Narration: "ramen",
+		Postings: []Posting{
+			Posting{Account: "Expenses:Food", Amount: dec("12.00"), Currency: "JPY"},
+			Posting{Account: "Assets:Cash"},
+		},
+	}
+	res := txn.sanitizedBase()
+	if !utf8.ValidString(res) || len(res) > 255-len(" _ 999") || !s.HasPrefix(res, "2016-02-12 _ 東京") {
+		t.Errorf("hey: %d %q", len(res), res)
+	}
+	if res = sanitizeFilename(s.Repeat("é", 200)); len(res) != 248 || !norm.NFC.IsNormalString(res) {
+		t.Errorf("hey: %d %q", len(res), res)
+	}
+}
+
+func TestTraversalRequests(t *testing.T) {
+	var err error
+	if staging, err = newStagingRegistry(); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer staging.cleanup()
+
+	// a file next to the staging folders which must not be touched
+	victim := filepath.Join(staging.root, "victim.txt")
+	if err = os.WriteFile(victim, []byte("x"), 0644); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	form := url.Values{"filename": {"../victim.txt"}}
+	r := httptest.NewRequest("POST", "/remove-from-tempdir", s.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Draft-Id", "laptop-draft")
+	w := httptest.NewRecorder()
+	removeFromTempdir(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("hey: %d", w.Code)
+	}
+	if ex, _ := exists(victim); !ex {
+		t.Errorf("hey: %s was removed", victim)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "..")
+	fw.Write([]byte("x"))
+	mw.Close()
+
+	r = httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-Draft-Id", "laptop-draft")
+	w = httptest.NewRecorder()
+	uploadHandler(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	bill := Bill{
+		Notes:      []Note{Note{Date: isodate("2016-02-12"), Account: "Assets:Bank", Description: "x"}},
+		Documents:  []Document{Document{Filename: "../../victim.txt"}},
+		StagingDir: "./testdata",
+	}
+	config.BillsFolder = "./testbills"
+	defer os.RemoveAll(config.BillsFolder)
+
+	if err = bill.Save(config); err == nil {
+		t.Errorf("hey: saved a document outside the staging folder")
+	}
+	if ex, _ := exists(config.BillsFolder); ex {
+		t.Errorf("hey: created %s", config.BillsFolder)
+	}
+}
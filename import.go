@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Bank statements are read into one bill per statement line, and saved the
+// same way as bills entered in the web app.
+
+// statementParser reads a statement into bills. profile selects the settings
+// for formats which need them, such as the column mapping of a CSV file.
+type statementParser func(c conf, profile string, r io.Reader) ([]Bill, error)
+
+var statementParsers = map[string]statementParser{
+	"csv": parseCSVStatement,
+	"ofx": parseOFXStatement,
+	// Quicken's name for the same
+	"qfx":     parseOFXStatement,
+	"camt053": parseCAMTStatement,
+	"mt940":   parseMT940Statement,
+}
+
+// Imported transactions are flagged for review, the counter posting is a
+// guess at best.
+const importFlag = "!"
+
+// importAccount finds the account of a statement in import_accounts by its
+// account number or IBAN, written with or without spaces.
+func (c conf) importAccount(ids ...string) (string, error) {
+	var tried []string
+	for _, id := range ids {
+		if len(id) == 0 {
+			continue
+		}
+		tried = append(tried, id)
+		if account, ok := c.ImportAccounts[id]; ok {
+			return account, nil
+		}
+		for key, account := range c.ImportAccounts {
+			if s.Replace(key, " ", "", -1) == s.Replace(id, " ", "", -1) {
+				return account, nil
+			}
+		}
+	}
+	return "", badRequest(errors.New(fmt.Sprintf("Add the account %q to import_accounts in config.yml", s.Join(tried, " or "))))
+}
+
+// decodeStatementText reads statements in the Windows-1252 charset many banks
+// use for OFX 1.x, MT940 and CSV files. Valid UTF-8 is kept as is.
+func decodeStatementText(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	// the 0x80-0x9F range, the rest is the same as Latin-1
+	cp1252 := []rune{
+		'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+		0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+	}
+
+	var b s.Builder
+	for _, c := range data {
+		if c >= 0x80 && c <= 0x9F {
+			b.WriteRune(cp1252[c-0x80])
+		} else {
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// importedBill makes the bill of a statement line. fitid is the bank's id of
+// the transaction, named as in OFX, empty when there is none.
+func importedBill(date time.Time, account string, amount Decimal, currency string, payee string, narration string, fitid string) Bill {
+	txn := Transaction{
+		Date:      date,
+		Flag:      importFlag,
+		Payee:     s.Replace(payee, `"`, `'`, -1),
+		Narration: s.Replace(narration, `"`, `'`, -1),
+		Postings: []Posting{
+			Posting{Account: account, Amount: amount, Currency: currency},
+			Posting{Account: defaultCounterAccount},
+		},
+	}
+
+	if len(fitid) > 0 {
+		txn.Meta = Metadata{MetaEntry{Key: "fitid", Value: strconv.Quote(fitid)}}
+	}
+
+	return Bill{Transactions: []Transaction{txn}}
+}
+
+// closingBalanceBill makes the balance assertion of a statement's closing
+// balance. The balance is at the end of the day, and a beancount balance is
+// checked at the start of its day, so it is dated the next day.
+func closingBalanceBill(date time.Time, account string, amount Decimal, currency string) Bill {
+	return Bill{Balances: []Balance{Balance{
+		Date:          date.AddDate(0, 0, 1),
+		Amount:        amount,
+		Currency:      currency,
+		SourceAccount: account,
+	}}}
+}
+
+// Why an entry of the statement was not saved.
+const (
+	skippedImported  = "imported"
+	skippedDuplicate = "duplicate"
+	skippedInvalid   = "invalid"
+)
+
+// skippedEntry is an entry of the statement which was not saved.
+type skippedEntry struct {
+	// the position of the entry in the statement, from 1
+	Entry int `json:"entry"`
+	// such as 2016-02-12 _ IKEA _ Shelf _ €55.95
+	Title  string `json:"title"`
+	Reason string `json:"reason"`
+	// the saved bills it looks like
+	Duplicates []duplicate `json:"duplicates,omitempty"`
+	// what doesn't pass the checks of checkBill
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+func (e skippedEntry) String() string {
+	switch e.Reason {
+	case skippedImported:
+		return fmt.Sprintf("Entry %d, %s: imported before", e.Entry, e.Title)
+	case skippedDuplicate:
+		var dirPaths []string
+		for _, d := range e.Duplicates {
+			dirPaths = append(dirPaths, fmt.Sprintf("%s (%s)", d.DirPath, d.Reason))
+		}
+		return fmt.Sprintf("Entry %d, %s: possible duplicate of %s", e.Entry, e.Title, s.Join(dirPaths, ", "))
+	case skippedInvalid:
+		return fmt.Sprintf("Entry %d, %s: %v", e.Entry, e.Title, validationError{Fields: e.Fields})
+	}
+	return fmt.Sprintf("Entry %d, %s: %s", e.Entry, e.Title, e.Reason)
+}
+
+type importResult struct {
+	DirPaths []string       `json:"dir_paths"`
+	Skipped  []skippedEntry `json:"skipped"`
+}
+
+// skippedCount counts the skipped entries of a reason.
+func (res importResult) skippedCount(reason string) int {
+	n := 0
+	for _, e := range res.Skipped {
+		if e.Reason == reason {
+			n++
+		}
+	}
+	return n
+}
+
+func (res importResult) summary() string {
+	msg := fmt.Sprintf("Imported %d bills, skipped %d imported before", len(res.DirPaths), res.skippedCount(skippedImported))
+	if n := res.skippedCount(skippedDuplicate); n > 0 {
+		msg += fmt.Sprintf(", %d possible duplicates", n)
+	}
+	if n := res.skippedCount(skippedInvalid); n > 0 {
+		msg += fmt.Sprintf(", %d which don't pass the checks", n)
+	}
+	return msg
+}
+
+// importedTitle names an imported bill in the result, as its folder would be
+// named by default.
+func importedTitle(b Bill) string {
+	l, err := b.layout()
+	if err != nil {
+		return ""
+	}
+	return l.Name
+}
+
+// importKeys identify what a bill imported, so that importing an overlapping
+// statement again doesn't save it twice: the bank's transaction id kept in
+// the fitid metadata, and balance assertions.
+func importKeys(bill Bill) []string {
+	var keys []string
+	for _, txn := range bill.Transactions {
+		if fitid := txn.Meta.Get("fitid"); len(fitid) > 0 && len(txn.Postings) > 0 {
+			keys = append(keys, fmt.Sprintf("fitid %s %s", txn.Postings[0].Account, fitid))
+		}
+	}
+	for _, bal := range bill.Balances {
+		keys = append(keys, fmt.Sprintf("balance %s %s %s", bal.Date.Format("2006-01-02"), bal.SourceAccount, bal.Currency))
+	}
+	return keys
+}
+
+// knownImportKeys collects the importKeys of the saved bills.
+func (c conf) knownImportKeys() map[string]bool {
+	known := make(map[string]bool)
+	for _, path := range c.billFilePaths() {
+		ledger, _ := ParseBeancountFile(path)
+		bill := Bill{Transactions: ledger.Transactions, Balances: ledger.Balances}
+		for _, key := range importKeys(bill) {
+			known[key] = true
+		}
+	}
+	return known
+}
+
+// saveImported saves the bills which were not imported before, stopping at
+// the first error. The bills saved so far are in the result. Unless
+// allowDuplicates, each bill is checked against the bills saved before the
+// import, and left out when it looks like one, such as a receipt entered by
+// hand. Entries of the statement itself are not compared, two coffees on the
+// same day are two bills. Bills which don't pass checkBill, such as with an
+// account which is not open, are left out too. What was left out is listed by
+// entry.
+func (c conf) saveImported(bills []Bill, allowDuplicates bool) (importResult, error) {
+	res := importResult{DirPaths: []string{}, Skipped: []skippedEntry{}}
+
+	known := c.knownImportKeys()
+
+	idx, err := c.checkIndex()
+	if err != nil {
+		return res, err
+	}
+
+	var saved []billEntry
+	if !allowDuplicates {
+		saved = c.listBills(billFilter{})
+	}
+
+	for i, bill := range bills {
+		keys := importKeys(bill)
+		skip := len(keys) > 0
+		for _, key := range keys {
+			if !known[key] {
+				skip = false
+			}
+		}
+		if skip {
+			res.Skipped = append(res.Skipped, skippedEntry{Entry: i + 1, Title: importedTitle(bill), Reason: skippedImported})
+			continue
+		}
+
+		if errs := idx.validate(bill); len(errs) > 0 {
+			res.Skipped = append(res.Skipped, skippedEntry{Entry: i + 1, Title: importedTitle(bill), Reason: skippedInvalid, Fields: errs})
+			continue
+		}
+
+		if !allowDuplicates {
+			if dups := c.findDuplicates(bill, saved, ""); len(dups) > 0 {
+				res.Skipped = append(res.Skipped, skippedEntry{Entry: i + 1, Title: importedTitle(bill), Reason: skippedDuplicate, Duplicates: dups})
+				continue
+			}
+		}
+
+		if err := bill.Save(c); err != nil {
+			return res, err
+		}
+		res.DirPaths = append(res.DirPaths, bill.DirPath)
+
+		for _, key := range keys {
+			known[key] = true
+		}
+	}
+
+	return res, nil
+}
+
+// importStatement parses the statement and saves its bills.
+func (c conf) importStatement(format string, profile string, r io.Reader, allowDuplicates bool) (importResult, error) {
+	parse, ok := statementParsers[format]
+	if !ok {
+		return importResult{}, badRequest(errors.New(fmt.Sprintf("Unknown statement format: %s", format)))
+	}
+
+	bills, err := parse(c, profile, r)
+	if err != nil {
+		return importResult{}, err
+	}
+
+	return c.saveImported(bills, allowDuplicates)
+}
+
+// Uses globals: config
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	format := mux.Vars(r)["format"]
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
+	defer file.Close()
+
+	allowDuplicates := r.FormValue("allow_duplicates") == "true"
+
+	res, err := config.importStatement(format, r.FormValue("profile"), file, allowDuplicates)
+	if err != nil {
+		// the bills saved before the error stay saved
+		data := make(map[string]interface{})
+		if len(res.DirPaths) > 0 {
+			data["flash"] = fmt.Sprintf("Imported %d bills, then: %v", len(res.DirPaths), err)
+			data["dir_paths"] = res.DirPaths
+		}
+		sendErrorData(w, err, data)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["flash"] = res.summary()
+	data["dir_paths"] = res.DirPaths
+	data["skipped"] = res.Skipped
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+func importCommands() []cli.Command {
+	var formats []string
+	for format := range statementParsers {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	var commands []cli.Command
+	for _, format := range formats {
+		commands = append(commands, cli.Command{
+			Name:      format,
+			Usage:     fmt.Sprintf("import a %s statement", format),
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "profile", Usage: "settings to use from config.yml"},
+				cli.BoolFlag{Name: "dry-run", Usage: "print the bills instead of saving them"},
+				cli.BoolFlag{Name: "allow-duplicates", Usage: "also save bills which look like saved bills"},
+			},
+			Action: actionImport(format),
+		})
+	}
+	return commands
+}
+
+// uses globals: config
+func actionImport(format string) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return cli.NewExitError(fmt.Sprintf("Usage: import %s [--profile NAME] FILE", format), 1)
+		}
+
+		f, err := os.Open(c.Args().First())
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer f.Close()
+
+		if c.Bool("dry-run") {
+			bills, err := statementParsers[format](config, c.String("profile"), f)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			for _, bill := range bills {
+				fmt.Printf("%s\n\n", bill.String())
+			}
+			return nil
+		}
+
+		res, err := config.importStatement(format, c.String("profile"), f, c.Bool("allow-duplicates"))
+		for _, dirPath := range res.DirPaths {
+			fmt.Printf("Saved: %s\n", dirPath)
+		}
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+
+		for _, e := range res.Skipped {
+			fmt.Printf("Skipped: %s\n", e)
+		}
+
+		fmt.Println(res.summary())
+
+		return nil
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	s "strings"
+	"time"
+)
+
+// ISO 20022 camt.053 bank to customer statements. Only the booked entries
+// are imported, and the closing booked balance (CLBD) becomes a balance
+// assertion. The account is found by the IBAN in import_accounts.
+
+type camtAmount struct {
+	Value    string `xml:",chardata"`
+	Currency string `xml:"Ccy,attr"`
+}
+
+type camtDate struct {
+	Date     string `xml:"Dt"`
+	DateTime string `xml:"DtTm"`
+}
+
+func (d camtDate) parse() (time.Time, error) {
+	text := d.Date
+	if len(text) == 0 {
+		text = d.DateTime
+	}
+	if len(text) < 10 {
+		return time.Time{}, errors.New(fmt.Sprintf("Not a camt date: %q", text))
+	}
+	return time.Parse("2006-01-02", text[0:10])
+}
+
+// camtParty has the name directly in camt.053.001.02, and in a Pty element
+// in later versions.
+type camtParty struct {
+	Name    string `xml:"Nm"`
+	PtyName string `xml:"Pty>Nm"`
+}
+
+func (p camtParty) name() string {
+	if len(p.Name) > 0 {
+		return p.Name
+	}
+	return p.PtyName
+}
+
+type camtTxDetails struct {
+	Creditor      camtParty `xml:"RltdPties>Cdtr"`
+	Debtor        camtParty `xml:"RltdPties>Dbtr"`
+	Unstructured  []string  `xml:"RmtInf>Ustrd"`
+	StructuredRef string    `xml:"RmtInf>Strd>CdtrRefInf>Ref"`
+}
+
+// camtStatus is a text in camt.053.001.02, and a Cd element in later
+// versions.
+type camtStatus struct {
+	Text string `xml:",chardata"`
+	Code string `xml:"Cd"`
+}
+
+type camtEntry struct {
+	Amount      camtAmount      `xml:"Amt"`
+	CreditDebit string          `xml:"CdtDbtInd"`
+	Status      camtStatus      `xml:"Sts"`
+	BookingDate camtDate        `xml:"BookgDt"`
+	ValueDate   camtDate        `xml:"ValDt"`
+	ServicerRef string          `xml:"AcctSvcrRef"`
+	AddtlInfo   string          `xml:"AddtlNtryInf"`
+	Details     []camtTxDetails `xml:"NtryDtls>TxDtls"`
+}
+
+type camtBalance struct {
+	Code        string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount      camtAmount `xml:"Amt"`
+	CreditDebit string     `xml:"CdtDbtInd"`
+	Date        camtDate   `xml:"Dt"`
+}
+
+type camtStatement struct {
+	IBAN     string        `xml:"Acct>Id>IBAN"`
+	OtherID  string        `xml:"Acct>Id>Othr>Id"`
+	Currency string        `xml:"Acct>Ccy"`
+	Balances []camtBalance `xml:"Bal"`
+	Entries  []camtEntry   `xml:"Ntry"`
+}
+
+type camtDocument struct {
+	Statements []camtStatement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+// signed applies the credit or debit indicator to the amount.
+func (a camtAmount) signed(creditDebit string) (Decimal, error) {
+	d, err := ParseDecimal(a.Value)
+	if err != nil {
+		return d, errors.New(fmt.Sprintf("Not a camt amount: %q", a.Value))
+	}
+	if creditDebit == "DBIT" {
+		d = d.Neg()
+	}
+	return d, nil
+}
+
+func (e camtEntry) booked() bool {
+	return e.Status.Code == "BOOK" || s.TrimSpace(e.Status.Text) == "BOOK"
+}
+
+// payeeAndNarration takes the counterparty, the creditor of payments going
+// out and the debtor of payments coming in, and the remittance information.
+func (e camtEntry) payeeAndNarration() (string, string) {
+	var payee string
+	var info []string
+
+	for _, d := range e.Details {
+		if len(payee) == 0 {
+			if e.CreditDebit == "DBIT" {
+				payee = d.Creditor.name()
+			} else {
+				payee = d.Debtor.name()
+			}
+		}
+		for _, u := range d.Unstructured {
+			info = append(info, s.TrimSpace(u))
+		}
+		if len(d.Unstructured) == 0 && len(d.StructuredRef) > 0 {
+			info = append(info, d.StructuredRef)
+		}
+	}
+
+	narration := s.Join(info, " ")
+	if len(narration) == 0 {
+		narration = s.TrimSpace(e.AddtlInfo)
+	}
+
+	return payee, narration
+}
+
+func (c conf) camtStatementBills(stmt camtStatement) ([]Bill, error) {
+	var bills []Bill
+
+	account, err := c.importAccount(stmt.IBAN, stmt.OtherID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range stmt.Entries {
+		if !e.booked() {
+			continue
+		}
+
+		date, err := e.BookingDate.parse()
+		if err != nil {
+			if date, err = e.ValueDate.parse(); err != nil {
+				return nil, badRequest(err)
+			}
+		}
+
+		amount, err := e.Amount.signed(e.CreditDebit)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		if amount.IsZero() {
+			continue
+		}
+
+		currency := e.Amount.Currency
+		if len(currency) == 0 {
+			currency = stmt.Currency
+		}
+
+		payee, narration := e.payeeAndNarration()
+
+		fitid := e.ServicerRef
+		if fitid == "NONREF" {
+			fitid = ""
+		}
+
+		bills = append(bills, importedBill(date, account, amount, currency, payee, narration, fitid))
+	}
+
+	for _, bal := range stmt.Balances {
+		if bal.Code != "CLBD" {
+			continue
+		}
+		date, err := bal.Date.parse()
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		amount, err := bal.Amount.signed(bal.CreditDebit)
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		currency := bal.Amount.Currency
+		if len(currency) == 0 {
+			currency = stmt.Currency
+		}
+		bills = append(bills, closingBalanceBill(date, account, amount, currency))
+	}
+
+	return bills, nil
+}
+
+func parseCAMTStatement(c conf, profile string, r io.Reader) ([]Bill, error) {
+	var doc camtDocument
+
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, badRequest(errors.New(fmt.Sprintf("Not a camt.053 file: %v", err)))
+	}
+	if len(doc.Statements) == 0 {
+		return nil, badRequest(errors.New("No statement in the camt.053 file"))
+	}
+
+	bills := []Bill{}
+	for _, stmt := range doc.Statements {
+		stmtBills, err := c.camtStatementBills(stmt)
+		if err != nil {
+			return nil, err
+		}
+		bills = append(bills, stmtBills...)
+	}
+
+	return bills, nil
+}
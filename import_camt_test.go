@@ -0,0 +1,85 @@
+package main
+
+import (
+	s "strings"
+	"testing"
+)
+
+const testCAMT = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <Stmt>
+      <Id>2016-02</Id>
+      <Acct><Id><IBAN>DE89370400440532013000</IBAN></Id><Ccy>EUR</Ccy></Acct>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>OPBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">1000.00</Amt><CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><Dt>2016-02-01</Dt></Dt>
+      </Bal>
+      <Bal>
+        <Tp><CdOrPrtry><Cd>CLBD</Cd></CdOrPrtry></Tp>
+        <Amt Ccy="EUR">944.05</Amt><CdtDbtInd>CRDT</CdtDbtInd>
+        <Dt><Dt>2016-02-29</Dt></Dt>
+      </Bal>
+      <Ntry>
+        <Amt Ccy="EUR">55.95</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <Sts>BOOK</Sts>
+        <BookgDt><Dt>2016-02-12</Dt></BookgDt>
+        <ValDt><Dt>2016-02-12</Dt></ValDt>
+        <AcctSvcrRef>REF-001</AcctSvcrRef>
+        <NtryDtls><TxDtls>
+          <RltdPties>
+            <Dbtr><Nm>Me</Nm></Dbtr>
+            <Cdtr><Nm>IKEA</Nm></Cdtr>
+          </RltdPties>
+          <RmtInf><Ustrd>Invoice 123</Ustrd><Ustrd>shelf</Ustrd></RmtInf>
+        </TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">2500.00</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <Sts>PDNG</Sts>
+        <BookgDt><Dt>2016-02-28</Dt></BookgDt>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>
+`
+
+func TestParseCAMTStatement(t *testing.T) {
+	c := conf{ImportAccounts: map[string]string{"DE89 3704 0044 0532 0130 00": "Assets:Bank:Checking"}}
+
+	bills, err := parseCAMTStatement(c, "", s.NewReader(testCAMT))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	// the pending entry is left out
+	if len(bills) != 2 {
+		t.Fatalf("hey: %d bills", len(bills))
+	}
+
+	expect := `2016-02-12 ! "IKEA" | "Invoice 123 shelf"
+  fitid: "REF-001"
+  Assets:Bank:Checking  -55.95 EUR
+  Expenses:Unknown      `
+	if res := bills[0].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	expect = `2016-03-01 balance Assets:Bank:Checking 944.05 EUR`
+	if res := bills[1].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	// camt.053.001.08 puts the status and the names one level down
+	v8 := s.Replace(testCAMT, "<Sts>BOOK</Sts>", "<Sts><Cd>BOOK</Cd></Sts>", 1)
+	v8 = s.Replace(v8, "<Cdtr><Nm>IKEA</Nm></Cdtr>", "<Cdtr><Pty><Nm>IKEA</Nm></Pty></Cdtr>", 1)
+	bills, err = parseCAMTStatement(c, "", s.NewReader(v8))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(bills) != 2 || bills[0].Transactions[0].Payee != "IKEA" {
+		t.Errorf("hey: %v", bills)
+	}
+}
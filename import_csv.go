@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	s "strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CSV statements are read with a profile from config.yml, one per bank
+// export:
+//
+//	csv_profiles:
+//	  mybank:
+//	    account: Assets:Bank:Checking
+//	    currency: EUR
+//	    delimiter: ";"
+//	    skip_rows: 3
+//	    header: true
+//	    date_column: Booking date
+//	    date_format: 02.01.2006
+//	    amount_column: Amount
+//	    decimal_separator: ","
+//	    payee_column: Counterparty
+//	    narration_column: Reference
+//
+// Columns are given by their header, or by their number starting at 1.
+type csvProfile struct {
+	// The account of the statement
+	Account string `yaml:"account"`
+	// The other posting of each transaction, Expenses:Unknown by default
+	CounterAccount string `yaml:"counter_account"`
+	Currency       string `yaml:"currency"`
+	// "," by default
+	Delimiter string `yaml:"delimiter"`
+	// Lines of the file before the header, or before the first row without a
+	// header. They don't have to be CSV.
+	SkipRows int  `yaml:"skip_rows"`
+	Header   bool `yaml:"header"`
+	// A Go time layout, 2006-01-02 by default
+	DateFormat string `yaml:"date_format"`
+	DateColumn string `yaml:"date_column"`
+	// A signed amount, or separate debit and credit columns
+	AmountColumn string `yaml:"amount_column"`
+	DebitColumn  string `yaml:"debit_column"`
+	CreditColumn string `yaml:"credit_column"`
+	// For statements where money going out is positive, such as many credit
+	// card statements
+	InvertSign       bool   `yaml:"invert_sign"`
+	DecimalSeparator string `yaml:"decimal_separator"`
+	// Optional, when the statement has more than one currency
+	CurrencyColumn  string `yaml:"currency_column"`
+	PayeeColumn     string `yaml:"payee_column"`
+	NarrationColumn string `yaml:"narration_column"`
+}
+
+const defaultCounterAccount = "Expenses:Unknown"
+
+// csvColumns are the indexes of the columns, -1 when not used.
+type csvColumns struct {
+	date, amount, debit, credit, currency, payee, narration int
+}
+
+// column finds a column by its header or number.
+func (p csvProfile) column(header []string, ref string) (int, error) {
+	if len(ref) == 0 {
+		return -1, nil
+	}
+	if n, err := strconv.Atoi(ref); err == nil && n > 0 {
+		return n - 1, nil
+	}
+	for i, h := range header {
+		if s.EqualFold(s.TrimSpace(h), s.TrimSpace(ref)) {
+			return i, nil
+		}
+	}
+	return -1, errors.New(fmt.Sprintf("No column %q in the CSV header", ref))
+}
+
+func (p csvProfile) columns(header []string) (csvColumns, error) {
+	var cols csvColumns
+	var err error
+
+	refs := []struct {
+		ref string
+		idx *int
+	}{
+		{p.DateColumn, &cols.date},
+		{p.AmountColumn, &cols.amount},
+		{p.DebitColumn, &cols.debit},
+		{p.CreditColumn, &cols.credit},
+		{p.CurrencyColumn, &cols.currency},
+		{p.PayeeColumn, &cols.payee},
+		{p.NarrationColumn, &cols.narration},
+	}
+
+	for _, r := range refs {
+		if *r.idx, err = p.column(header, r.ref); err != nil {
+			return cols, err
+		}
+	}
+
+	if cols.date < 0 {
+		return cols, errors.New("The CSV profile needs a date_column")
+	}
+	if cols.amount < 0 && cols.debit < 0 && cols.credit < 0 {
+		return cols, errors.New("The CSV profile needs an amount_column, or debit_column and credit_column")
+	}
+
+	return cols, nil
+}
+
+var csvAmountJunkRe = regexp.MustCompile(`[^0-9.,()+-]`)
+
+// parseAmount reads amounts such as "1.234,56", "(12.00)", "12.00-" and
+// "€ 12.00".
+func (p csvProfile) parseAmount(text string) (Decimal, error) {
+	sep := p.DecimalSeparator
+	if len(sep) == 0 {
+		sep = "."
+	}
+
+	num := csvAmountJunkRe.ReplaceAllString(text, "")
+	if len(num) == 0 {
+		return Decimal{}, nil
+	}
+
+	negative := false
+	if s.HasPrefix(num, "(") && s.HasSuffix(num, ")") {
+		negative = true
+		num = s.Trim(num, "()")
+	}
+	if s.HasSuffix(num, "-") {
+		negative = true
+		num = s.TrimSuffix(num, "-")
+	}
+
+	// drop the thousands separators
+	if sep == "," {
+		num = s.Replace(num, ".", "", -1)
+		num = s.Replace(num, ",", ".", -1)
+	} else {
+		num = s.Replace(num, ",", "", -1)
+	}
+
+	d, err := ParseDecimal(num)
+	if err != nil {
+		return d, errors.New(fmt.Sprintf("Not an amount: %q", text))
+	}
+	if negative {
+		d = d.Neg()
+	}
+	return d, nil
+}
+
+func field(row []string, idx int) string {
+	if idx < 0 || idx >= len(row) {
+		return ""
+	}
+	return s.TrimSpace(row[idx])
+}
+
+// rowBill makes the bill of a statement row.
+func (p csvProfile) rowBill(cols csvColumns, row []string) (Bill, error) {
+	var bill Bill
+
+	layout := p.DateFormat
+	if len(layout) == 0 {
+		layout = "2006-01-02"
+	}
+	date, err := time.Parse(layout, field(row, cols.date))
+	if err != nil {
+		return bill, errors.New(fmt.Sprintf("Not a date as %s: %q", layout, field(row, cols.date)))
+	}
+
+	var amount Decimal
+	if cols.amount >= 0 {
+		if amount, err = p.parseAmount(field(row, cols.amount)); err != nil {
+			return bill, err
+		}
+	} else {
+		debit, err := p.parseAmount(field(row, cols.debit))
+		if err != nil {
+			return bill, err
+		}
+		credit, err := p.parseAmount(field(row, cols.credit))
+		if err != nil {
+			return bill, err
+		}
+		// some banks write debits with a minus, some without
+		amount = credit.Abs().Sub(debit.Abs())
+	}
+	if p.InvertSign {
+		amount = amount.Neg()
+	}
+
+	currency := p.Currency
+	if c := field(row, cols.currency); len(c) > 0 {
+		currency = s.ToUpper(c)
+	}
+	if len(currency) == 0 {
+		return bill, errors.New("No currency, set currency in the CSV profile")
+	}
+
+	bill = importedBill(date, p.Account, amount, currency, field(row, cols.payee), field(row, cols.narration), "")
+	if len(p.CounterAccount) > 0 {
+		bill.Transactions[0].Postings[1].Account = p.CounterAccount
+	}
+
+	return bill, nil
+}
+
+func parseCSVStatement(c conf, profile string, r io.Reader) ([]Bill, error) {
+	p, ok := c.CSVProfiles[profile]
+	if !ok {
+		return nil, badRequest(errors.New(fmt.Sprintf("No CSV profile %q in config.yml", profile)))
+	}
+	if len(p.Account) == 0 {
+		return nil, errors.New(fmt.Sprintf("The CSV profile %q needs an account", profile))
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lines are skipped before reading CSV, bank exports often start
+	// with a few lines which aren't
+	buffered := bufio.NewReader(s.NewReader(decodeStatementText(data)))
+	for i := 0; i < p.SkipRows; i++ {
+		if line, err := buffered.ReadString('\n'); err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, badRequest(errors.New("The CSV file is shorter than skip_rows"))
+		}
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if len(p.Delimiter) > 0 {
+		if p.Delimiter == `\t` {
+			reader.Comma = '\t'
+		} else {
+			reader.Comma, _ = utf8.DecodeRuneInString(p.Delimiter)
+		}
+	}
+
+	// the line each row starts on in the file, a quoted field can span
+	// lines
+	var rows [][]string
+	var lines []int
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				perr.StartLine += p.SkipRows
+				perr.Line += p.SkipRows
+			}
+			return nil, badRequest(err)
+		}
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, row)
+		lines = append(lines, line+p.SkipRows)
+	}
+
+	var header []string
+	if p.Header && len(rows) > 0 {
+		header = rows[0]
+		if len(header) > 0 {
+			header[0] = s.TrimPrefix(header[0], "\ufeff")
+		}
+		rows = rows[1:]
+		lines = lines[1:]
+	}
+
+	cols, err := p.columns(header)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	bills := []Bill{}
+	for i, row := range rows {
+		if len(s.TrimSpace(s.Join(row, ""))) == 0 {
+			continue
+		}
+		bill, err := p.rowBill(cols, row)
+		if err != nil {
+			return nil, badRequest(errors.New(fmt.Sprintf("Line %d: %v", lines[i], err)))
+		}
+		// nothing to book, and both postings would be without an amount
+		if bill.Transactions[0].Postings[0].Amount.IsZero() {
+			continue
+		}
+		bills = append(bills, bill)
+	}
+
+	return bills, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+const testStatementCSV = `My Bank statement
+Account;DE00 1234
+Booking date;Counterparty;Reference;Amount
+12.02.2016;IKEA;"Shelf ""Billy""";-1.234,56
+13.02.2016;Employer Ltd;Salary February;2.500,00
+;;;
+14.02.2016;Café;Coffee;-2,50
+`
+
+func testCSVProfiles() map[string]csvProfile {
+	return map[string]csvProfile{
+		"mybank": csvProfile{
+			Account:          "Assets:Bank:Checking",
+			Currency:         "EUR",
+			Delimiter:        ";",
+			SkipRows:         2,
+			Header:           true,
+			DateColumn:       "Booking date",
+			DateFormat:       "02.01.2006",
+			AmountColumn:     "Amount",
+			DecimalSeparator: ",",
+			PayeeColumn:      "Counterparty",
+			NarrationColumn:  "Reference",
+		},
+		"card": csvProfile{
+			Account:         "Liabilities:CreditCard",
+			CounterAccount:  "Expenses:Card",
+			Currency:        "USD",
+			DateColumn:      "1",
+			NarrationColumn: "2",
+			DebitColumn:     "3",
+			CreditColumn:    "4",
+		},
+	}
+}
+
+func TestParseCSVStatement(t *testing.T) {
+	c := conf{CSVProfiles: testCSVProfiles()}
+
+	bills, err := parseCSVStatement(c, "mybank", s.NewReader(testStatementCSV))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(bills) != 3 {
+		t.Fatalf("hey: %d bills", len(bills))
+	}
+
+	expect := `2016-02-12 ! "IKEA" | "Shelf 'Billy'"
+  Assets:Bank:Checking  -1234.56 EUR
+  Expenses:Unknown      `
+	if res := bills[0].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	if amount := bills[1].Transactions[0].Postings[0].Amount; amount.Cmp(dec("2500")) != 0 {
+		t.Errorf("hey: %s", amount)
+	}
+
+	card := "2016-03-01,Books,12.00,\n2016-03-02,Refund,,5.00\n"
+	bills, err = parseCSVStatement(c, "card", s.NewReader(card))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if amount := bills[0].Transactions[0].Postings[0].Amount; amount.Cmp(dec("-12")) != 0 {
+		t.Errorf("hey: %s", amount)
+	}
+	if amount := bills[1].Transactions[0].Postings[0].Amount; amount.Cmp(dec("5")) != 0 {
+		t.Errorf("hey: %s", amount)
+	}
+	if account := bills[1].Transactions[0].Postings[1].Account; account != "Expenses:Card" {
+		t.Errorf("hey: %s", account)
+	}
+
+	if _, err = parseCSVStatement(c, "card", s.NewReader("01/03/2016,Books,12.00,\n")); err == nil ||
+		!s.Contains(err.Error(), "Line 1") {
+		t.Errorf("hey: %v", err)
+	}
+
+	// a preamble which isn't CSV, and a reference over two lines
+	statement := "My \"Bank\n\nBooking date;Counterparty;Reference;Amount\n" +
+		"12.02.2016;IKEA;\"Shelf\nBilly\";-1,00\n\n12.13.2016;IKEA;Lamp;-2,00\n"
+	if _, err = parseCSVStatement(c, "mybank", s.NewReader(statement)); err == nil ||
+		!s.Contains(err.Error(), "Line 7") {
+		t.Errorf("hey: %v", err)
+	}
+
+	// exported in Windows-1252
+	bills, err = parseCSVStatement(c, "card", s.NewReader("2016-03-01,Caf\xe9 \x80 menu,12.00,\n"))
+	if err != nil || len(bills) != 1 || bills[0].Transactions[0].Narration != "Café € menu" {
+		t.Errorf("hey: %v %v", bills, err)
+	}
+
+	if _, err = parseCSVStatement(c, "nope", s.NewReader(card)); err == nil {
+		t.Errorf("hey: imported without a profile")
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.CSVProfiles = testCSVProfiles()
+	defer os.RemoveAll(config.BillsFolder)
+
+	post := func() *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("profile", "mybank")
+		fw, _ := mw.CreateFormFile("file", "statement.csv")
+		fw.Write([]byte(testStatementCSV))
+		mw.Close()
+
+		r := httptest.NewRequest("POST", "/import/csv", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r = mux.SetURLVars(r, map[string]string{"format": "csv"})
+		w := httptest.NewRecorder()
+		importHandler(w, r)
+		return w
+	}
+
+	w := post()
+	if w.Code != http.StatusOK {
+		t.Fatalf("hey: %d %s", w.Code, w.Body)
+	}
+
+	var data struct {
+		DirPaths []string       `json:"dir_paths"`
+		Skipped  []skippedEntry `json:"skipped"`
+	}
+	json.NewDecoder(w.Body).Decode(&data)
+
+	if len(data.DirPaths) != 3 {
+		t.Fatalf("hey: %v", data.DirPaths)
+	}
+	if ex, _ := exists(filepath.Join(config.BillsFolder, "2016", "02", "2016-02-12 _ IKEA _ Shelf 'Billy' _ €1234.56", "bill.beancount")); !ex {
+		t.Errorf("hey: %v", data.DirPaths)
+	}
+
+	// the same statement again, CSV rows have no bank id
+	w = post()
+	data.DirPaths = nil
+	json.NewDecoder(w.Body).Decode(&data)
+	if w.Code != http.StatusOK || len(data.DirPaths) != 0 || len(data.Skipped) != 3 ||
+		data.Skipped[2].Entry != 3 || data.Skipped[2].Reason != skippedDuplicate {
+		t.Errorf("hey: %d %v", w.Code, data)
+	}
+}
+
+func TestSaveImportedChecks(t *testing.T) {
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.MainBeancountFile = "./testbills/main.beancount"
+	config.CSVProfiles = testCSVProfiles()
+	defer func() { config.MainBeancountFile = "" }()
+	defer os.RemoveAll(config.BillsFolder)
+
+	os.MkdirAll(config.BillsFolder, 0755)
+	ioutil.WriteFile(config.MainBeancountFile, []byte(`2016-02-13 open Assets:Bank:Checking EUR
+2016-01-01 open Expenses:Unknown
+include "includes.beancount"
+`), 0644)
+
+	res, err := config.importStatement("csv", "mybank", s.NewReader(testStatementCSV), false)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(res.DirPaths) != 2 || len(res.Skipped) != 1 {
+		t.Fatalf("hey: %v", res)
+	}
+
+	// the account was opened the day after
+	skipped := res.Skipped[0]
+	if skipped.Entry != 1 || skipped.Reason != skippedInvalid || len(skipped.Fields) != 1 ||
+		skipped.Fields[0].Field != "transactions[0].postings[0].account" {
+		t.Errorf("hey: %v", skipped)
+	}
+	if msg := skipped.String(); !s.HasPrefix(msg, "Entry 1, 2016-02-12 _ IKEA") {
+		t.Errorf("hey: %s", msg)
+	}
+}
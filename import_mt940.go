@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	s "strings"
+	"time"
+)
+
+// SWIFT MT940 statements. Each :61: statement line with its :86:
+// information becomes a transaction, and the closing balance :62F: a balance
+// assertion. The account is found by the :25: account identification in
+// import_accounts.
+
+type mt940Field struct {
+	tag   string
+	value string
+}
+
+var mt940TagRe = regexp.MustCompile(`^:([0-9]{2}[A-Z]?):(.*)$`)
+
+// mt940Statements splits the fields into statements, each starting at :20:
+func mt940Statements(text string) [][]mt940Field {
+	var statements [][]mt940Field
+	var fields []mt940Field
+
+	text = s.Replace(text, "\r\n", "\n", -1)
+
+	for _, line := range s.Split(text, "\n") {
+		// the SWIFT message blocks around the statement
+		if s.HasPrefix(line, "{") || s.HasPrefix(line, "-}") || s.TrimSpace(line) == "-" {
+			continue
+		}
+
+		if m := mt940TagRe.FindStringSubmatch(line); m != nil {
+			if m[1] == "20" && len(fields) > 0 {
+				statements = append(statements, fields)
+				fields = nil
+			}
+			fields = append(fields, mt940Field{tag: m[1], value: m[2]})
+			continue
+		}
+
+		// continuation line
+		if len(fields) > 0 && len(line) > 0 {
+			fields[len(fields)-1].value += "\n" + line
+		}
+	}
+
+	if len(fields) > 0 {
+		statements = append(statements, fields)
+	}
+
+	return statements
+}
+
+func parseMT940Amount(text string) (Decimal, error) {
+	d, err := ParseDecimal(s.Replace(text, ",", ".", 1))
+	if err != nil {
+		return d, errors.New(fmt.Sprintf("Not an MT940 amount: %q", text))
+	}
+	return d, nil
+}
+
+var mt940BalanceRe = regexp.MustCompile(`^([CD])([0-9]{6})([A-Z]{3})([0-9]+,[0-9]*)`)
+
+// parseMT940Balance reads balances such as C160229EUR1178,61
+func parseMT940Balance(text string) (time.Time, string, Decimal, error) {
+	m := mt940BalanceRe.FindStringSubmatch(s.TrimSpace(text))
+	if m == nil {
+		return time.Time{}, "", Decimal{}, errors.New(fmt.Sprintf("Not an MT940 balance: %q", text))
+	}
+	date, err := time.Parse("060102", m[2])
+	if err != nil {
+		return date, "", Decimal{}, err
+	}
+	amount, err := parseMT940Amount(m[4])
+	if err != nil {
+		return date, "", amount, err
+	}
+	if m[1] == "D" {
+		amount = amount.Neg()
+	}
+	return date, m[3], amount, nil
+}
+
+// value date, entry date, debit or credit mark, funds code, amount,
+// transaction type, customer reference, bank reference
+var mt940LineRe = regexp.MustCompile(`^([0-9]{6})([0-9]{4})?(R?[CD])([A-Z])?([0-9]+,[0-9]*)([NSF][A-Z0-9]{3})([^/\n]*)(?://([^\n]*))?`)
+
+type mt940Line struct {
+	date      time.Time
+	amount    Decimal
+	bankRef   string
+	payee     string
+	narration string
+}
+
+func parseMT940Line(text string) (mt940Line, error) {
+	var line mt940Line
+
+	m := mt940LineRe.FindStringSubmatch(text)
+	if m == nil {
+		return line, errors.New(fmt.Sprintf("Not an MT940 statement line: %q", text))
+	}
+
+	valueDate, err := time.Parse("060102", m[1])
+	if err != nil {
+		return line, err
+	}
+	line.date = valueDate
+
+	// the entry date has no year, it is close to the value date
+	if len(m[2]) > 0 {
+		entryDate, err := time.Parse("20060102", fmt.Sprintf("%04d%s", valueDate.Year(), m[2]))
+		if err == nil {
+			if entryDate.Sub(valueDate) > 180*24*time.Hour {
+				entryDate = entryDate.AddDate(-1, 0, 0)
+			} else if valueDate.Sub(entryDate) > 180*24*time.Hour {
+				entryDate = entryDate.AddDate(1, 0, 0)
+			}
+			line.date = entryDate
+		}
+	}
+
+	if line.amount, err = parseMT940Amount(m[5]); err != nil {
+		return line, err
+	}
+	// a reversal of a credit takes money out, of a debit brings it back
+	if m[3] == "D" || m[3] == "RC" {
+		line.amount = line.amount.Neg()
+	}
+
+	line.bankRef = s.TrimSpace(m[8])
+	if line.bankRef == "NONREF" {
+		line.bankRef = ""
+	}
+
+	return line, nil
+}
+
+var mt940SubfieldRe = regexp.MustCompile(`\?([0-9]{2})`)
+var mt940CodeRe = regexp.MustCompile(`/([A-Z]{4})/`)
+
+// parseMT940Info reads the payee and narration of a :86: field. German banks
+// structure it with ?20 to ?29 for the purpose and ?32 ?33 for the name,
+// others with codes such as /NAME/ and /REMI/. Anything else is the
+// narration as it is.
+func parseMT940Info(text string) (string, string) {
+	text = s.Replace(text, "\n", "", -1)
+
+	if mt940SubfieldRe.MatchString(text) {
+		parts := mt940SubfieldRe.Split(text, -1)
+		codes := mt940SubfieldRe.FindAllStringSubmatch(text, -1)
+
+		var purpose, name []string
+		for i, c := range codes {
+			value := parts[i+1]
+			switch {
+			case c[1] >= "20" && c[1] <= "29", c[1] >= "60" && c[1] <= "63":
+				purpose = append(purpose, value)
+			case c[1] == "32" || c[1] == "33":
+				name = append(name, value)
+			}
+		}
+
+		narration := s.Join(purpose, "")
+		// SEPA purpose after the end to end and mandate references
+		if i := s.Index(narration, "SVWZ+"); i >= 0 {
+			narration = narration[i+len("SVWZ+"):]
+		}
+		return s.TrimSpace(s.Join(name, "")), s.TrimSpace(narration)
+	}
+
+	if mt940CodeRe.MatchString(text) {
+		values := make(map[string]string)
+		locs := mt940CodeRe.FindAllStringSubmatchIndex(text, -1)
+		for i, loc := range locs {
+			end := len(text)
+			if i+1 < len(locs) {
+				end = locs[i+1][0]
+			}
+			code := text[loc[2]:loc[3]]
+			if _, ok := values[code]; !ok {
+				values[code] = s.Trim(text[loc[1]:end], "/ ")
+			}
+		}
+		if len(values["NAME"]) > 0 || len(values["REMI"]) > 0 {
+			return values["NAME"], values["REMI"]
+		}
+	}
+
+	return "", s.TrimSpace(text)
+}
+
+func (c conf) mt940StatementBills(fields []mt940Field) ([]Bill, error) {
+	var bills []Bill
+	var account, currency string
+	var err error
+
+	for _, f := range fields {
+		if f.tag == "25" {
+			// BLZ/account number or IBAN, possibly with the currency
+			if account, err = c.importAccount(s.TrimSpace(f.value)); err != nil {
+				return nil, err
+			}
+		}
+		if f.tag == "60F" || f.tag == "60M" {
+			if _, currency, _, err = parseMT940Balance(f.value); err != nil {
+				return nil, badRequest(err)
+			}
+		}
+	}
+
+	if len(account) == 0 {
+		return nil, badRequest(errors.New("No :25: account in the MT940 statement"))
+	}
+
+	for i, f := range fields {
+		switch f.tag {
+		case "61":
+			line, err := parseMT940Line(f.value)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			if line.amount.IsZero() {
+				continue
+			}
+			if i+1 < len(fields) && fields[i+1].tag == "86" {
+				line.payee, line.narration = parseMT940Info(fields[i+1].value)
+			}
+			if len(currency) == 0 {
+				return nil, badRequest(errors.New("No :60F: opening balance with the currency in the MT940 statement"))
+			}
+			bills = append(bills, importedBill(line.date, account, line.amount, currency, line.payee, line.narration, line.bankRef))
+		case "62F":
+			date, balCurrency, amount, err := parseMT940Balance(f.value)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			bills = append(bills, closingBalanceBill(date, account, amount, balCurrency))
+		}
+	}
+
+	return bills, nil
+}
+
+func parseMT940Statement(c conf, profile string, r io.Reader) ([]Bill, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := mt940Statements(decodeStatementText(data))
+	if len(statements) == 0 {
+		return nil, badRequest(errors.New("No statement in the MT940 file"))
+	}
+
+	bills := []Bill{}
+	for _, stmt := range statements {
+		stmtBills, err := c.mt940StatementBills(stmt)
+		if err != nil {
+			return nil, err
+		}
+		bills = append(bills, stmtBills...)
+	}
+
+	return bills, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	s "strings"
+	"testing"
+)
+
+const testMT940 = `{1:F01BANKDEFFXXXX0000000000}{2:O9401200160301BANKDEFFXXXX00000000001603011200N}{4:
+:20:STMT2016-02
+:25:37040044/0532013000
+:28C:2/1
+:60F:C160201EUR1000,00
+:61:1602120212DR55,95NTRFNONREF//BANK-1
+:86:166?00SEPA-UEBERWEISUNG?20EREF+123?21SVWZ+Invoice 123 she
+?22lf?32IKEA Deutschland G?33mbH
+:61:1602150215CR2500,00NTRFNONREF//BANK-2
+:86:/NAME/Employer Ltd/REMI/Salary February/
+:61:1602200220DR3,00NMSCNONREF
+:86:Account fee
+:62F:C160229EUR3441,05
+-}
+`
+
+func TestParseMT940Statement(t *testing.T) {
+	c := conf{ImportAccounts: map[string]string{"37040044/0532013000": "Assets:Bank:Checking"}}
+
+	bills, err := parseMT940Statement(c, "", s.NewReader(testMT940))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(bills) != 4 {
+		t.Fatalf("hey: %d bills", len(bills))
+	}
+
+	expect := `2016-02-12 ! "IKEA Deutschland GmbH" | "Invoice 123 shelf"
+  fitid: "BANK-1"
+  Assets:Bank:Checking  -55.95 EUR
+  Expenses:Unknown      `
+	if res := bills[0].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	txn := bills[1].Transactions[0]
+	if txn.Payee != "Employer Ltd" || txn.Narration != "Salary February" || txn.Postings[0].Amount.Cmp(dec("2500")) != 0 {
+		t.Errorf("hey: %v", txn)
+	}
+
+	txn = bills[2].Transactions[0]
+	if txn.Narration != "Account fee" || len(txn.Meta) != 0 {
+		t.Errorf("hey: %v", txn)
+	}
+
+	expect = `2016-03-01 balance Assets:Bank:Checking 3441.05 EUR`
+	if res := bills[3].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+}
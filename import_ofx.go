@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	s "strings"
+	"time"
+)
+
+// OFX statements, both the SGML of OFX 1.x, where the value elements are not
+// closed, and the XML of OFX 2.x. The account of each statement is found by
+// its ACCTID in the import_accounts of config.yml:
+//
+//	import_accounts:
+//	  "12345678": Assets:Bank:Checking
+//	  "4111111111111111": Liabilities:CreditCard
+
+// ofxNode is an element, either with a value or with children.
+type ofxNode struct {
+	name     string
+	value    string
+	children []*ofxNode
+	parent   *ofxNode
+	// a value element, which is closed by the next tag in SGML
+	leaf bool
+}
+
+// child returns the first element with the path of names below the node.
+func (n *ofxNode) child(names ...string) *ofxNode {
+	if len(names) == 0 {
+		return n
+	}
+	for _, c := range n.children {
+		if c.name == names[0] {
+			if found := c.child(names[1:]...); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// get returns the value of the element with the path of names, or "".
+func (n *ofxNode) get(names ...string) string {
+	if c := n.child(names...); c != nil {
+		return c.value
+	}
+	return ""
+}
+
+// all returns the elements with the name anywhere below the node.
+func (n *ofxNode) all(name string) []*ofxNode {
+	var found []*ofxNode
+	for _, c := range n.children {
+		if c.name == name {
+			found = append(found, c)
+		}
+		found = append(found, c.all(name)...)
+	}
+	return found
+}
+
+var ofxTokenRe = regexp.MustCompile(`<(/?)([A-Za-z0-9.]+)[^>]*>|[^<]+`)
+
+// parseOFX reads the elements from the <OFX> tag on, the header before it is
+// skipped.
+func parseOFX(text string) (*ofxNode, error) {
+	start := s.Index(s.ToUpper(text), "<OFX>")
+	if start < 0 {
+		return nil, errors.New("Not an OFX file, no <OFX> tag")
+	}
+
+	root := &ofxNode{}
+	top := root
+
+	// closes a value element left open in SGML
+	closeLeaf := func() {
+		if top.leaf {
+			top = top.parent
+		}
+	}
+
+	for _, m := range ofxTokenRe.FindAllStringSubmatch(text[start:], -1) {
+		if len(m[2]) == 0 {
+			value := s.TrimSpace(m[0])
+			if len(value) == 0 || top == root {
+				continue
+			}
+			top.value = html.UnescapeString(value)
+			top.leaf = true
+			continue
+		}
+
+		name := s.ToUpper(m[2])
+
+		if m[1] == "/" {
+			if top.leaf && top.name != name {
+				closeLeaf()
+			}
+			// unwind to the element being closed, when it is open
+			for n := top; n != root; n = n.parent {
+				if n.name == name {
+					top = n.parent
+					break
+				}
+			}
+			continue
+		}
+
+		closeLeaf()
+		node := &ofxNode{name: name, parent: top}
+		top.children = append(top.children, node)
+		top = node
+	}
+
+	ofx := root.child("OFX")
+	if ofx == nil {
+		return nil, errors.New("Not an OFX file, no <OFX> tag")
+	}
+
+	return ofx, nil
+}
+
+var ofxDateRe = regexp.MustCompile(`^[0-9]{8}`)
+
+// parseOFXDate reads the date of values such as 20160212,
+// 20160212120000.000 and 20160212120000[-5:EST]
+func parseOFXDate(text string) (time.Time, error) {
+	m := ofxDateRe.FindString(text)
+	if len(m) == 0 {
+		return time.Time{}, errors.New(fmt.Sprintf("Not an OFX date: %q", text))
+	}
+	return time.Parse("20060102", m)
+}
+
+func parseOFXAmount(text string) (Decimal, error) {
+	text = s.Replace(s.TrimSpace(text), " ", "", -1)
+	// some banks write a decimal comma
+	if !s.Contains(text, ".") {
+		text = s.Replace(text, ",", ".", 1)
+	}
+	d, err := ParseDecimal(text)
+	if err != nil {
+		return d, errors.New(fmt.Sprintf("Not an OFX amount: %q", text))
+	}
+	return d, nil
+}
+
+// ofxStatementBills makes the bills of one STMTRS or CCSTMTRS element.
+func (c conf) ofxStatementBills(stmt *ofxNode) ([]Bill, error) {
+	var bills []Bill
+
+	acctID := stmt.get("BANKACCTFROM", "ACCTID")
+	if len(acctID) == 0 {
+		acctID = stmt.get("CCACCTFROM", "ACCTID")
+	}
+	account, err := c.importAccount(acctID)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := stmt.get("CURDEF")
+	if len(currency) == 0 {
+		return nil, badRequest(errors.New(fmt.Sprintf("No CURDEF in the statement of %q", acctID)))
+	}
+
+	for _, trn := range stmt.all("STMTTRN") {
+		date, err := parseOFXDate(trn.get("DTPOSTED"))
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		amount, err := parseOFXAmount(trn.get("TRNAMT"))
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		if amount.IsZero() {
+			continue
+		}
+
+		payee := trn.get("NAME")
+		if len(payee) == 0 {
+			payee = trn.get("PAYEE", "NAME")
+		}
+
+		txnCurrency := currency
+		if cur := trn.get("CURRENCY", "CURSYM"); len(cur) > 0 {
+			txnCurrency = cur
+		}
+
+		bills = append(bills, importedBill(date, account, amount, txnCurrency, payee, trn.get("MEMO"), trn.get("FITID")))
+	}
+
+	if bal := stmt.child("LEDGERBAL"); bal != nil {
+		date, err := parseOFXDate(bal.get("DTASOF"))
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		amount, err := parseOFXAmount(bal.get("BALAMT"))
+		if err != nil {
+			return nil, badRequest(err)
+		}
+		bills = append(bills, closingBalanceBill(date, account, amount, currency))
+	}
+
+	return bills, nil
+}
+
+func parseOFXStatement(c conf, profile string, r io.Reader) ([]Bill, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ofx, err := parseOFX(decodeStatementText(data))
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	stmts := append(ofx.all("STMTRS"), ofx.all("CCSTMTRS")...)
+	if len(stmts) == 0 {
+		return nil, badRequest(errors.New("No statement in the OFX file"))
+	}
+
+	bills := []Bill{}
+	for _, stmt := range stmts {
+		stmtBills, err := c.ofxStatementBills(stmt)
+		if err != nil {
+			return nil, err
+		}
+		bills = append(bills, stmtBills...)
+	}
+
+	return bills, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	s "strings"
+	"testing"
+)
+
+const testOFX1 = "OFXHEADER:100\r\nDATA:OFXSGML\r\nVERSION:102\r\nCHARSET:1252\r\n\r\n" +
+	`<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20160301</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>1<STMTRS>
+<CURDEF>EUR
+<BANKACCTFROM><BANKID>123<ACCTID>DE001234<ACCTTYPE>CHECKING</BANKACCTFROM>
+<BANKTRANLIST><DTSTART>20160201<DTEND>20160229
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20160212120000.000[-5:EST]<TRNAMT>-55.95<FITID>2016021201<NAME>IKEA &amp; Co<MEMO>Shelf</STMTTRN>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20160214<TRNAMT>-2.50<FITID>2016021401<NAME>Caf` + "\xe9" + `</STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL><BALAMT>1234.56<DTASOF>20160229</LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+
+const testOFX2 = `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="211" SECURITY="NONE"?>
+<OFX>
+  <CREDITCARDMSGSRSV1>
+    <CCSTMTTRNRS>
+      <CCSTMTRS>
+        <CURDEF>USD</CURDEF>
+        <CCACCTFROM><ACCTID>4111</ACCTID></CCACCTFROM>
+        <BANKTRANLIST>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20160303</DTPOSTED>
+            <TRNAMT>-12.00</TRNAMT>
+            <FITID>A1</FITID>
+            <NAME>Bookshop</NAME>
+            <MEMO></MEMO>
+          </STMTTRN>
+        </BANKTRANLIST>
+        <LEDGERBAL><BALAMT>-12.00</BALAMT><DTASOF>20160331120000</DTASOF></LEDGERBAL>
+      </CCSTMTRS>
+    </CCSTMTTRNRS>
+  </CREDITCARDMSGSRSV1>
+</OFX>
+`
+
+func TestParseOFXStatement(t *testing.T) {
+	c := conf{ImportAccounts: map[string]string{
+		"DE001234": "Assets:Bank:Checking",
+		"4111":     "Liabilities:CreditCard",
+	}}
+
+	bills, err := parseOFXStatement(c, "", s.NewReader(testOFX1))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(bills) != 3 {
+		t.Fatalf("hey: %d bills", len(bills))
+	}
+
+	expect := `2016-02-12 ! "IKEA & Co" | "Shelf"
+  fitid: "2016021201"
+  Assets:Bank:Checking  -55.95 EUR
+  Expenses:Unknown      `
+	if res := bills[0].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	if payee := bills[1].Transactions[0].Payee; payee != "Café" {
+		t.Errorf("hey: %s", payee)
+	}
+
+	expect = `2016-03-01 balance Assets:Bank:Checking 1234.56 EUR`
+	if res := bills[2].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	bills, err = parseOFXStatement(c, "", s.NewReader(testOFX2))
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(bills) != 2 {
+		t.Fatalf("hey: %d bills", len(bills))
+	}
+
+	expect = `2016-03-03 ! "Bookshop" | ""
+  fitid: "A1"
+  Liabilities:CreditCard  -12.00 USD
+  Expenses:Unknown        `
+	if res := bills[0].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	expect = `2016-04-01 balance Liabilities:CreditCard -12.00 USD`
+	if res := bills[1].String(); res != expect {
+		t.Errorf("hey: %s", res)
+	}
+
+	if _, err = parseOFXStatement(conf{}, "", s.NewReader(testOFX2)); err == nil {
+		t.Errorf("hey: imported without the account")
+	}
+}
+
+func TestImportOFXTwice(t *testing.T) {
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.ImportAccounts = map[string]string{"DE001234": "Assets:Bank:Checking"}
+	defer os.RemoveAll(config.BillsFolder)
+
+	res, err := config.importStatement("ofx", "", s.NewReader(testOFX1), false)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(res.DirPaths) != 3 || len(res.Skipped) != 0 {
+		t.Errorf("hey: %v", res)
+	}
+
+	res, err = config.importStatement("ofx", "", s.NewReader(testOFX1), false)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if len(res.DirPaths) != 0 || res.skippedCount(skippedImported) != 3 || res.Skipped[2].Entry != 3 {
+		t.Errorf("hey: %v", res)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+// The amounts and dates typed in the web app are read as they are written
+// where the user is, set in config.yml:
+//
+//	input_locale:
+//	  decimal_separator: ","
+//	  thousands_separator: "."
+//	  date_order: dmy
+//	  currency_symbols:
+//	    R$: BRL
+//
+// so that "1.234,56 €" and "12/02/2016" are read as 1234.56 EUR and
+// 2016-02-12. Bills are always written in beancount's own syntax.
+type inputLocale struct {
+	// "." by default
+	DecimalSeparator string `yaml:"decimal_separator"`
+	// "," by default, or "." when the decimal separator is ",". Spaces are
+	// always accepted.
+	ThousandsSeparator string `yaml:"thousands_separator"`
+	// ymd, dmy or mdy for dates such as 12/02/2016, ymd by default.
+	// 2016-02-12 is always read.
+	DateOrder string `yaml:"date_order"`
+	// More symbols than €, £ and $, with their currency
+	CurrencySymbols map[string]string `yaml:"currency_symbols"`
+}
+
+var defaultCurrencySymbols = map[string]string{
+	"€": "EUR",
+	"£": "GBP",
+	"$": "USD",
+}
+
+func (l inputLocale) decimalSeparator() string {
+	if len(l.DecimalSeparator) == 0 {
+		return "."
+	}
+	return l.DecimalSeparator
+}
+
+func (l inputLocale) thousandsSeparator() string {
+	if len(l.ThousandsSeparator) > 0 {
+		return l.ThousandsSeparator
+	}
+	if l.decimalSeparator() == "," {
+		return "."
+	}
+	return ","
+}
+
+// symbolCurrency returns the currency of a symbol or a currency code, or "".
+func (l inputLocale) symbolCurrency(text string) string {
+	if cur, ok := l.CurrencySymbols[text]; ok {
+		return cur
+	}
+	if cur, ok := defaultCurrencySymbols[text]; ok {
+		return cur
+	}
+	if currencyCodeRe.MatchString(text) {
+		return text
+	}
+	return ""
+}
+
+var currencyCodeRe = regexp.MustCompile(`^[A-Z][A-Z0-9'._-]*[A-Z0-9]$`)
+
+// isDigitSpace are the spaces written between groups of digits.
+func isDigitSpace(r rune) bool {
+	return r == ' ' || r == '\u00a0' || r == '\u202f'
+}
+
+// parseAmount reads amounts such as "1.234,56", "-5.50 €", "€-5.50" and
+// "12.00 EUR". currency is the currency of a symbol or code with the amount,
+// "" when there is none. An empty text is zero, for the posting left for
+// beancount to fill in.
+func (l inputLocale) parseAmount(text string) (amount Decimal, currency string, err error) {
+	text = s.TrimSpace(text)
+	if len(text) == 0 {
+		return Decimal{}, "", nil
+	}
+
+	notAmount := errors.New(fmt.Sprintf("Not an amount: %q", text))
+	dec, thousands := l.decimalSeparator(), l.thousandsSeparator()
+
+	// the number runs from the first digit, or a decimal separator before
+	// one, to the last digit
+	start := s.IndexAny(text, "0123456789")
+	end := s.LastIndexAny(text, "0123456789")
+	if start < 0 {
+		return Decimal{}, "", notAmount
+	}
+	if s.HasSuffix(text[:start], dec) {
+		start -= len(dec)
+	}
+	prefix, num, suffix := s.TrimSpace(text[:start]), text[start:end+1], s.TrimSpace(text[end+1:])
+
+	sign := ""
+	if s.HasPrefix(prefix, "-") || s.HasPrefix(prefix, "+") {
+		sign, prefix = prefix[:1], s.TrimSpace(prefix[1:])
+	} else if s.HasSuffix(prefix, "-") || s.HasSuffix(prefix, "+") {
+		sign, prefix = prefix[len(prefix)-1:], s.TrimSpace(prefix[:len(prefix)-1])
+	}
+
+	for _, sym := range []string{prefix, suffix} {
+		if len(sym) == 0 {
+			continue
+		}
+		cur := l.symbolCurrency(sym)
+		if len(cur) == 0 || (len(currency) > 0 && cur != currency) {
+			return Decimal{}, "", notAmount
+		}
+		currency = cur
+	}
+
+	intPart, fracPart := num, ""
+	if i := s.LastIndex(num, dec); i >= 0 {
+		intPart, fracPart = num[:i], num[i+len(dec):]
+	}
+	for _, r := range fracPart {
+		if r < '0' || r > '9' {
+			return Decimal{}, "", notAmount
+		}
+	}
+
+	// thousands separators only between groups of three digits
+	groups := s.FieldsFunc(intPart, func(r rune) bool {
+		return s.ContainsRune(thousands, r) || isDigitSpace(r)
+	})
+	if len(groups) > 1 {
+		for i, g := range groups {
+			if (i == 0 && len(g) > 3) || (i > 0 && len(g) != 3) {
+				return Decimal{}, "", notAmount
+			}
+		}
+	}
+	intPart = s.Join(groups, "")
+
+	plain := intPart
+	if len(plain) == 0 {
+		plain = "0"
+	}
+	if i := s.LastIndex(num, dec); i >= 0 {
+		plain += "." + fracPart
+	}
+	if amount, err = ParseDecimal(sign + plain); err != nil {
+		return Decimal{}, "", notAmount
+	}
+	return amount, currency, nil
+}
+
+var localDateRe = regexp.MustCompile(`^([0-9]{1,4})[./-]([0-9]{1,2})[./-]([0-9]{1,4})$`)
+
+// parseDate reads 2016-02-12, a timestamp starting with it, and dates in the
+// date_order such as 12/02/2016 or 12.02.16.
+func (l inputLocale) parseDate(text string) (time.Time, error) {
+	text = s.TrimSpace(text)
+	if len(text) == 0 {
+		return time.Time{}, errors.New("Date is missing")
+	}
+	if date, err := time.Parse("2006-01-02", text); err == nil {
+		return date, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, text); err == nil {
+		return time.Parse("2006-01-02", ts.Format("2006-01-02"))
+	}
+
+	order := s.ToLower(l.DateOrder)
+	if len(order) == 0 {
+		order = "ymd"
+	}
+	notDate := errors.New(fmt.Sprintf("Not a date: %q, expected %s", text, dateOrderExample(order)))
+
+	m := localDateRe.FindStringSubmatch(text)
+	if m == nil || (order != "ymd" && order != "dmy" && order != "mdy") {
+		return time.Time{}, notDate
+	}
+
+	parts := map[byte]string{order[0]: m[1], order[1]: m[2], order[2]: m[3]}
+	if (len(parts['y']) != 2 && len(parts['y']) != 4) || len(parts['d']) > 2 || len(parts['m']) > 2 {
+		return time.Time{}, notDate
+	}
+
+	year, _ := strconv.Atoi(parts['y'])
+	if len(parts['y']) == 2 {
+		year += 2000
+	}
+	month, _ := strconv.Atoi(parts['m'])
+	day, _ := strconv.Atoi(parts['d'])
+
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	// 31.02. would be in March
+	if date.Month() != time.Month(month) || date.Day() != day {
+		return time.Time{}, notDate
+	}
+	return date, nil
+}
+
+// amountCurrency is the currency of a posting or balance, which can also be
+// given by a symbol with the amount.
+func amountCurrency(currency string, symbolCurrency string) (string, error) {
+	if len(symbolCurrency) == 0 {
+		return currency, nil
+	}
+	if len(currency) > 0 && currency != symbolCurrency {
+		return currency, errors.New(fmt.Sprintf("The amount is in %s, not %s", symbolCurrency, currency))
+	}
+	return symbolCurrency, nil
+}
+
+func dateOrderExample(order string) string {
+	switch order {
+	case "dmy":
+		return "DD.MM.YYYY or YYYY-MM-DD"
+	case "mdy":
+		return "MM/DD/YYYY or YYYY-MM-DD"
+	}
+	return "YYYY-MM-DD"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestInputLocaleParseAmount(t *testing.T) {
+	german := inputLocale{DecimalSeparator: ","}
+	english := inputLocale{}
+
+	amounts := []struct {
+		locale   inputLocale
+		text     string
+		amount   string
+		currency string
+	}{
+		{english, "5.50", "5.50", ""},
+		{english, "-1,234.56", "-1234.56", ""},
+		{english, "$-12", "-12", "USD"},
+		{english, ".5", "0.5", ""},
+		{english, "12.00 EUR", "12.00", "EUR"},
+		{german, "1.234,56", "1234.56", ""},
+		{german, "-5,50 €", "-5.50", "EUR"},
+		{german, "-€5,50", "-5.50", "EUR"},
+		{german, "1 234 567,8", "1234567.8", ""},
+		{german, "1234", "1234", ""},
+		{inputLocale{DecimalSeparator: ",", CurrencySymbols: map[string]string{"R$": "BRL"}}, "R$ 10,00", "10.00", "BRL"},
+		{inputLocale{ThousandsSeparator: "'"}, "1'000.05", "1000.05", ""},
+	}
+
+	for _, a := range amounts {
+		amount, currency, err := a.locale.parseAmount(a.text)
+		if err != nil {
+			t.Errorf("hey: %q: %v", a.text, err)
+			continue
+		}
+		if amount.Cmp(dec(a.amount)) != 0 || amount.String() != a.amount || currency != a.currency {
+			t.Errorf("hey: %q: %s %s", a.text, amount.String(), currency)
+		}
+	}
+
+	invalid := []struct {
+		locale inputLocale
+		text   string
+	}{
+		{english, "5,50"},
+		{english, "5.5.0"},
+		{english, "5.50-"},
+		{english, "5O"},
+		{english, "€5 $"},
+		{english, "12,34,567"},
+		{german, "1.23,4"},
+		{german, "5,"},
+		{german, "abc"},
+	}
+
+	for _, a := range invalid {
+		if amount, _, err := a.locale.parseAmount(a.text); err == nil {
+			t.Errorf("hey: %q read as %s", a.text, amount.String())
+		}
+	}
+}
+
+func TestInputLocaleParseDate(t *testing.T) {
+	dates := []struct {
+		order string
+		text  string
+		date  string
+	}{
+		{"", "2016-02-12", "2016-02-12"},
+		{"", "2016-02-12T23:30:00+01:00", "2016-02-12"},
+		{"dmy", "2016-02-12", "2016-02-12"},
+		{"dmy", "12.02.2016", "2016-02-12"},
+		{"dmy", "12/2/16", "2016-02-12"},
+		{"mdy", "02/12/2016", "2016-02-12"},
+		{"ymd", "2016/2/12", "2016-02-12"},
+	}
+
+	for _, d := range dates {
+		date, err := inputLocale{DateOrder: d.order}.parseDate(d.text)
+		if err != nil || date.Format("2006-01-02") != d.date {
+			t.Errorf("hey: %s %q: %v %v", d.order, d.text, date, err)
+		}
+	}
+
+	invalid := []struct {
+		order string
+		text  string
+	}{
+		{"", "12.02.2016"},
+		{"dmy", "31.02.2016"},
+		{"dmy", "12.13.2016"},
+		{"dmy", "12.02.201"},
+		{"mdy", "13/02/2016"},
+		{"dmy", ""},
+		{"yd", "2016/12"},
+	}
+
+	for _, d := range invalid {
+		if date, err := (inputLocale{DateOrder: d.order}).parseDate(d.text); err == nil {
+			t.Errorf("hey: %s %q read as %v", d.order, d.text, date)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	s "strings"
+	"text/template"
+	"time"
+)
+
+// Bill folders are laid out by two templates of the conf: the folders under
+// the bills folder, and the name of the bill folder itself. Both are given the
+// first transaction, balance or note of the bill, the one which decides its
+// date.
+
+const defaultBillFolderTemplate = `{{.Year}}/{{.Month}}`
+const defaultBillNameTemplate = `{{.Name}}`
+
+type billLayout struct {
+	// transaction, balance or note
+	Kind string
+	// 2016-02-12, and as a time for .Time.Format
+	Date    string
+	Time    time.Time
+	Year    string
+	Month   string
+	Day     string
+	Quarter int
+	Flag    string
+	Payee   string
+	// the narration, or the description of a note
+	Narration string
+	// the first posting's, the balance's or the note's
+	Account string
+	// as in the default name, such as €5.50
+	Amount   string
+	Currency string
+	Tags     []string
+	Links    []string
+	// the default name, date _ payee _ narration _ amount
+	Name string
+}
+
+var layoutFuncs = template.FuncMap{
+	"lower":   s.ToLower,
+	"upper":   s.ToUpper,
+	"replace": func(text, old, new string) string { return s.Replace(text, old, new, -1) },
+}
+
+// layout is what the templates see of the bill.
+func (b Bill) layout() (billLayout, error) {
+	var l billLayout
+
+	date, account := b.documentDefaults()
+	l.Time = date
+	l.Date = date.Format("2006-01-02")
+	l.Year = fmt.Sprintf("%04d", date.Year())
+	l.Month = fmt.Sprintf("%02d", date.Month())
+	l.Day = fmt.Sprintf("%02d", date.Day())
+	l.Quarter = (int(date.Month())-1)/3 + 1
+	l.Account = account
+
+	if len(b.Transactions) > 0 {
+		t := b.Transactions[0]
+		l.Kind = "transaction"
+		l.Flag = t.Flag
+		// only the template's slashes make folders
+		l.Payee = s.Replace(t.Payee, "/", " ", -1)
+		l.Narration = s.Replace(t.Narration, "/", " ", -1)
+		l.Amount = t.sumAmountFmt()
+		if len(t.Postings) > 0 {
+			l.Currency = t.Postings[0].Currency
+		}
+		l.Tags = t.Tags
+		l.Links = t.Links
+		l.Name = t.sanitizedBase()
+	} else if len(b.Balances) > 0 {
+		bal := b.Balances[0]
+		l.Kind = "balance"
+		l.Amount = bal.Amount.FormatCurrency(bal.Currency)
+		l.Currency = bal.Currency
+		l.Name = bal.sanitizedBase()
+	} else if len(b.Notes) > 0 {
+		note := b.Notes[0]
+		l.Kind = "note"
+		l.Narration = s.Replace(note.Description, "/", " ", -1)
+		l.Name = note.sanitizedBase()
+	} else {
+		return l, errors.New(fmt.Sprintf("Need at least one transaction, balance or note"))
+	}
+
+	return l, nil
+}
+
+// layoutTemplates parses the folder and name templates, or the defaults.
+func (c conf) layoutTemplates() (folder *template.Template, name *template.Template, err error) {
+	folderText := c.BillFolderTemplate
+	if len(folderText) == 0 {
+		folderText = defaultBillFolderTemplate
+	}
+	nameText := c.BillNameTemplate
+	if len(nameText) == 0 {
+		nameText = defaultBillNameTemplate
+	}
+
+	folder, err = template.New("bill_folder_template").Funcs(layoutFuncs).Option("missingkey=error").Parse(folderText)
+	if err != nil {
+		return nil, nil, err
+	}
+	name, err = template.New("bill_name_template").Funcs(layoutFuncs).Option("missingkey=error").Parse(nameText)
+	if err != nil {
+		return nil, nil, err
+	}
+	return folder, name, nil
+}
+
+// layoutDirPath is the folder where the bill belongs according to the layout.
+func (c conf) layoutDirPath(b Bill) (string, error) {
+	l, err := b.layout()
+	if err != nil {
+		return "", err
+	}
+
+	folderTmpl, nameTmpl, err := c.layoutTemplates()
+	if err != nil {
+		return "", err
+	}
+
+	var folder, name bytes.Buffer
+	if err = folderTmpl.Execute(&folder, l); err != nil {
+		return "", err
+	}
+	if err = nameTmpl.Execute(&name, l); err != nil {
+		return "", err
+	}
+
+	parts := []string{c.BillsFolder}
+	for _, segment := range s.Split(folder.String(), "/") {
+		if segment = sanitizeFilename(segment); len(segment) > 0 {
+			parts = append(parts, segment)
+		}
+	}
+
+	base := sanitizeFilename(name.String())
+	if len(base) == 0 {
+		return "", errors.New(fmt.Sprintf("The bill name template gives an empty name for %s", l.Date))
+	}
+	parts = append(parts, base)
+
+	return filepath.Join(parts...), nil
+}
+
+// billFilePaths lists the beancount files of every bill in the bills folder,
+// at any depth, as the layout decides it. Hidden folders, such as the staging
+// folders of bills being saved, are skipped.
+//
+// Any .beancount file in a bill folder counts, as with the glob of earlier
+// versions, bills written by hand don't have to be named bill.beancount. The
+// main and includes files are left out when they are in the bills folder.
+func (c conf) billFilePaths() []string {
+	return billFilePathsIn(c.BillsFolder, c.MainBeancountFile, c.IncludesBeancountFile)
+}
+
+// billFilePathsIn lists the beancount files in the folders under folder, such
+// as the bills folder or the trash, but not the skip files.
+func billFilePathsIn(folder string, skip ...string) []string {
+	var paths []string
+
+	skipped := make(map[string]bool)
+	for _, path := range skip {
+		if abs, err := filepath.Abs(path); err == nil && len(path) > 0 {
+			skipped[abs] = true
+		}
+	}
+
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != folder && s.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(info.Name()) != ".beancount" || filepath.Dir(path) == filepath.Clean(folder) {
+			return nil
+		}
+		if abs, err := filepath.Abs(path); err == nil && skipped[abs] {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+
+	return paths
+}
+
+// isBillFile is true for the beancount files which are bills of their own
+// folder, the ones which can be edited and moved.
+func isBillFile(path string) bool {
+	return filepath.Base(path) == (Bill{}).BeancountFilename()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayoutDirPath(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-05-12"),
+				Payee:     "AC/DC Tickets",
+				Narration: "concert",
+				Postings: []Posting{
+					Posting{Account: "Expenses:Fun:Music", Amount: dec("55.95"), Currency: "USD"},
+					Posting{Account: "Assets:Cash"},
+				},
+			},
+		},
+	}
+
+	layouts := []struct {
+		folder string
+		name   string
+		expect string
+	}{
+		{"", "", "bills/2016/05/2016-05-12 _ AC DC Tickets _ concert _ $55.95"},
+		{`{{.Year}}/Q{{.Quarter}}/{{replace .Account ":" "/"}}`, "", "bills/2016/Q2/Expenses/Fun/Music/2016-05-12 _ AC DC Tickets _ concert _ $55.95"},
+		{`{{.Payee}}`, `{{.Date}} {{lower .Narration}} {{.Amount}}`, "bills/AC DC Tickets/2016-05-12 concert $55.95"},
+		{`{{.Year}}/{{if .Flag}}{{.Flag}}{{end}}/..`, `{{.Time.Format "02.01.2006"}}`, "bills/2016/12.05.2016"},
+	}
+
+	for _, l := range layouts {
+		c := conf{BillsFolder: "bills", BillFolderTemplate: l.folder, BillNameTemplate: l.name}
+		res, err := c.layoutDirPath(bill)
+		if err != nil || res != filepath.FromSlash(l.expect) {
+			t.Errorf("hey: %q %q: %s %v", l.folder, l.name, res, err)
+		}
+	}
+
+	invalid := []conf{
+		conf{BillFolderTemplate: `{{.Year}`},
+		conf{BillFolderTemplate: `{{.Month.Name}}`},
+		conf{BillNameTemplate: `{{.Flag}}`},
+	}
+
+	for _, c := range invalid {
+		if res, err := c.layoutDirPath(bill); err == nil {
+			t.Errorf("hey: %q %q gave %s", c.BillFolderTemplate, c.BillNameTemplate, res)
+		}
+	}
+}
+
+func TestBillFilePathsFollowLayout(t *testing.T) {
+	bill := Bill{
+		Notes: []Note{
+			Note{Date: isodate("2016-05-12"), Account: "Assets:Bank:Checking", Description: "new card"},
+		},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.BillFolderTemplate = `{{.Year}}/Q{{.Quarter}}/{{replace .Account ":" "/"}}`
+	defer func() { config.BillFolderTemplate = "" }()
+	defer os.RemoveAll(config.BillsFolder)
+
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	os.MkdirAll(filepath.Join(config.BillsFolder, saveStagingPrefix+"x"), 0755)
+	os.Create(filepath.Join(config.BillsFolder, saveStagingPrefix+"x", bill.BeancountFilename()))
+
+	// a bill written by hand, and the main file kept with the bills
+	os.MkdirAll(filepath.Join(config.BillsFolder, "2015", "rent"), 0755)
+	ioutil.WriteFile(filepath.Join(config.BillsFolder, "2015", "rent", "rent.beancount"), []byte("2015-01-01 note Assets:Cash \"rent\"\n"), 0644)
+	config.MainBeancountFile = filepath.Join(config.BillsFolder, "ledger", "main.beancount")
+	defer func() { config.MainBeancountFile = "" }()
+	os.MkdirAll(filepath.Dir(config.MainBeancountFile), 0755)
+	ioutil.WriteFile(config.MainBeancountFile, []byte("include \"../includes.beancount\"\n"), 0644)
+
+	expect := []string{
+		filepath.Join(config.BillsFolder, "2015", "rent", "rent.beancount"),
+		filepath.Join(config.BillsFolder, "2016", "Q2", "Assets", "Bank", "Checking", "2016-05-12 _ note", bill.BeancountFilename()),
+	}
+	paths := config.billFilePaths()
+	if len(paths) != 2 || paths[0] != expect[0] || paths[1] != expect[1] {
+		t.Errorf("hey: %v", paths)
+	}
+
+	// the includes file of the conf it is called on
+	c := config
+	c.IncludesBeancountFile = filepath.Join(config.BillsFolder, "other.beancount")
+	if err := c.updateIncludesBeancountFile(); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	includes, _ := ioutil.ReadFile(c.IncludesBeancountFile)
+	if string(includes) != "include \"2015/rent/rent.beancount\"\ninclude \"2016/Q2/Assets/Bank/Checking/2016-05-12 _ note/bill.beancount\"" {
+		t.Errorf("hey: %s", includes)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Where the web app listens:
+//
+//   listen_address: 127.0.0.1  # only this host, all interfaces when empty
+//   server_port: 3030
+//   listen_socket: /run/b2b/b2b.sock  # a Unix socket instead of TCP
+//   tls_cert: ./cert.pem
+//   tls_key: ./key.pem
+//   tls_self_signed: true  # creates tls_cert and tls_key when missing
+
+var listenFlags = []cli.Flag{
+	cli.StringFlag{Name: "listen", Usage: "address to listen on, such as 127.0.0.1"},
+	cli.IntFlag{Name: "port", Usage: "port to listen on"},
+	cli.StringFlag{Name: "socket", Usage: "listen on this Unix socket instead of TCP"},
+	cli.StringFlag{Name: "tls-cert", Usage: "TLS certificate file"},
+	cli.StringFlag{Name: "tls-key", Usage: "TLS key file"},
+	cli.BoolFlag{Name: "self-signed", Usage: "use a self-signed TLS certificate, created when missing"},
+}
+
+// applyListenFlags overrides the config.yml settings with the command line.
+func (c *conf) applyListenFlags(ctx *cli.Context) {
+	if ctx.IsSet("listen") {
+		c.ListenAddress = ctx.String("listen")
+	}
+	if ctx.IsSet("port") {
+		c.ServerPort = ctx.Int("port")
+	}
+	if ctx.IsSet("socket") {
+		c.ListenSocket = ctx.String("socket")
+	}
+	if ctx.IsSet("tls-cert") {
+		c.TLSCert = ctx.String("tls-cert")
+	}
+	if ctx.IsSet("tls-key") {
+		c.TLSKey = ctx.String("tls-key")
+	}
+	if ctx.IsSet("self-signed") {
+		c.TLSSelfSigned = ctx.Bool("self-signed")
+	}
+}
+
+func (c conf) useTLS() bool {
+	return c.TLSSelfSigned || len(c.TLSCert) > 0
+}
+
+func (c conf) scheme() string {
+	if c.useTLS() {
+		return "https"
+	}
+	return "http"
+}
+
+// listensOnAll reports whether the address is empty or 0.0.0.0 or ::
+func (c conf) listensOnAll() bool {
+	if len(c.ListenAddress) == 0 {
+		return true
+	}
+	ip := net.ParseIP(c.ListenAddress)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func (c conf) urlFor(host string) string {
+	return fmt.Sprintf("%s://%s", c.scheme(), net.JoinHostPort(host, strconv.Itoa(c.ServerPort)))
+}
+
+// listenURL is the address for a browser on this machine.
+func (c conf) listenURL() string {
+	if len(c.ListenSocket) > 0 {
+		return "unix:" + c.ListenSocket
+	}
+	if c.listensOnAll() {
+		return c.urlFor("localhost")
+	}
+	return c.urlFor(c.ListenAddress)
+}
+
+// localAddress is the address for other devices, such as a phone on the LAN.
+// Behind a reverse proxy it is the address the request came in with.
+func (c conf) localAddress(r *http.Request) string {
+	if len(c.ListenSocket) > 0 {
+		scheme := r.Header.Get("X-Forwarded-Proto")
+		if len(scheme) == 0 {
+			scheme = "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+		}
+		return fmt.Sprintf("%s://%s", scheme, r.Host)
+	}
+	if c.listensOnAll() {
+		if ip := GetLocalIP(); len(ip) > 0 {
+			return c.urlFor(ip)
+		}
+		return c.urlFor("localhost")
+	}
+	return c.urlFor(c.ListenAddress)
+}
+
+// listen opens the Unix socket or TCP port, with TLS when configured.
+func (c conf) listen() (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	if len(c.ListenSocket) > 0 {
+		// left behind when the last run was killed
+		if f, err := os.Lstat(c.ListenSocket); err == nil && f.Mode()&os.ModeSocket != 0 {
+			os.Remove(c.ListenSocket)
+		}
+		if l, err = net.Listen("unix", c.ListenSocket); err != nil {
+			return nil, err
+		}
+		// the reverse proxy usually runs as another user of the group
+		if err = os.Chmod(c.ListenSocket, 0660); err != nil {
+			l.Close()
+			return nil, err
+		}
+	} else {
+		if l, err = net.Listen("tcp", net.JoinHostPort(c.ListenAddress, strconv.Itoa(c.ServerPort))); err != nil {
+			return nil, err
+		}
+	}
+
+	if !c.useTLS() {
+		return l, nil
+	}
+
+	cert, err := c.tlsCertificate()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
+
+func (c conf) tlsCertificate() (tls.Certificate, error) {
+	certFile, keyFile := c.TLSCert, c.TLSKey
+
+	if c.TLSSelfSigned {
+		if len(certFile) == 0 {
+			certFile = "./b2b-cert.pem"
+		}
+		if len(keyFile) == 0 {
+			keyFile = "./b2b-key.pem"
+		}
+		certExists, _ := exists(certFile)
+		keyExists, _ := exists(keyFile)
+		// kept across restarts, so that the phone only has to accept it once
+		if !certExists && !keyExists {
+			if err := c.writeSelfSignedCert(certFile, keyFile); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	}
+
+	if len(keyFile) == 0 {
+		return tls.Certificate{}, errors.New("tls_key is needed with tls_cert")
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// selfSignedHosts are the names and addresses the certificate is valid for.
+func (c conf) selfSignedHosts() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+
+	if c.listensOnAll() {
+		if addrs, err := net.InterfaceAddrs(); err == nil {
+			for _, address := range addrs {
+				if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+					ips = append(ips, ipnet.IP)
+				}
+			}
+		}
+	} else if ip := net.ParseIP(c.ListenAddress); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		names = append(names, c.ListenAddress)
+	}
+
+	return names, ips
+}
+
+func (c conf) writeSelfSignedCert(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	names, ips := c.selfSignedHosts()
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"bills-to-beans"}, CommonName: names[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// phones refuse certificates valid for longer
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certFile, keyFile} {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = ioutil.WriteFile(certFile, certPem, 0644); err != nil {
+		return err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenURL(t *testing.T) {
+	var urls = map[string]conf{
+		"http://localhost:3030":  conf{ServerPort: 3030},
+		"https://localhost:3030": conf{ServerPort: 3030, ListenAddress: "0.0.0.0", TLSSelfSigned: true},
+		"http://127.0.0.1:8080":  conf{ServerPort: 8080, ListenAddress: "127.0.0.1"},
+		"https://[::1]:3030":     conf{ServerPort: 3030, ListenAddress: "::1", TLSCert: "cert.pem"},
+		"unix:/run/b2b.sock":     conf{ServerPort: 3030, ListenSocket: "/run/b2b.sock"},
+	}
+
+	for expect, c := range urls {
+		if res := c.listenURL(); res != expect {
+			t.Errorf("hey: %s != %s", res, expect)
+		}
+	}
+
+	c := conf{ServerPort: 8080, ListenAddress: "127.0.0.1"}
+	r := httptest.NewRequest("GET", "/", nil)
+	if res := c.localAddress(r); res != "http://127.0.0.1:8080" {
+		t.Errorf("hey: %s", res)
+	}
+
+	c = conf{ListenSocket: "/run/b2b.sock"}
+	r = httptest.NewRequest("GET", "http://bills.example.com/", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if res := c.localAddress(r); res != "https://bills.example.com" {
+		t.Errorf("hey: %s", res)
+	}
+}
+
+func TestListenSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b2b_listen")
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := conf{ListenSocket: filepath.Join(dir, "b2b.sock")}
+
+	l, err := c.listen()
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("beans"))
+	}))
+	defer l.Close()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", c.ListenSocket)
+		},
+	}}
+
+	res, err := client.Get("http://bills/")
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "beans" {
+		t.Errorf("hey: %s", body)
+	}
+}
+
+func TestListenSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b2b_listen")
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := conf{
+		ListenAddress: "127.0.0.1",
+		ServerPort:    0,
+		TLSSelfSigned: true,
+		TLSCert:       filepath.Join(dir, "cert.pem"),
+		TLSKey:        filepath.Join(dir, "key.pem"),
+	}
+
+	l, err := c.listen()
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("beans"))
+	}))
+	defer l.Close()
+
+	cert, _ := ioutil.ReadFile(c.TLSCert)
+
+	client := http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	res, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "beans" {
+		t.Errorf("hey: %s", body)
+	}
+
+	// the certificate is reused on the next start
+	l2, err := c.listen()
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	l2.Close()
+	if again, _ := ioutil.ReadFile(c.TLSCert); string(again) != string(cert) {
+		t.Errorf("hey: the certificate was created again")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+type billFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+}
+
+type billEntry struct {
+	Bill      Bill       `json:"bill"`
+	DirPath   string     `json:"dir_path"`
+	Documents []billFile `json:"documents"`
+}
+
+// billFilter selects bills for the listing, empty fields match everything.
+type billFilter struct {
+	From    time.Time
+	To      time.Time
+	Account string
+	Payee   string
+	Tag     string
+	Link    string
+}
+
+func isSubAccount(account string, parent string) bool {
+	return account == parent || s.HasPrefix(account, parent+":")
+}
+
+func (f billFilter) matches(b Bill) bool {
+	date := b.Date()
+	if !f.From.IsZero() && date.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && date.After(f.To) {
+		return false
+	}
+
+	if len(f.Account) > 0 {
+		var accounts []string
+		for _, txn := range b.Transactions {
+			for _, p := range txn.Postings {
+				accounts = append(accounts, p.Account)
+			}
+		}
+		for _, bal := range b.Balances {
+			accounts = append(accounts, bal.SourceAccount, bal.TargetAccount)
+		}
+		for _, note := range b.Notes {
+			accounts = append(accounts, note.Account)
+		}
+		for _, doc := range b.Documents {
+			accounts = append(accounts, doc.Account)
+		}
+
+		found := false
+		for _, acc := range accounts {
+			if isSubAccount(acc, f.Account) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Payee) > 0 {
+		found := false
+		for _, txn := range b.Transactions {
+			if s.Contains(s.ToLower(txn.Payee), s.ToLower(f.Payee)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Tag) > 0 {
+		tag := "#" + s.TrimPrefix(f.Tag, "#")
+		found := false
+		for _, txn := range b.Transactions {
+			for _, t := range txn.Tags {
+				if t == tag {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Link) > 0 {
+		link := "^" + s.TrimPrefix(f.Link, "^")
+		found := false
+		for _, txn := range b.Transactions {
+			for _, l := range txn.Links {
+				if l == link {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listBills reads every bill matching the filter, newest first. Bills which
+// can't be read are logged and left out.
+func (c conf) listBills(filter billFilter) []billEntry {
+	entries := []billEntry{}
+
+	for _, path := range c.billFilePaths() {
+		// other beancount files are read with the bill.beancount of their folder
+		if !isBillFile(path) {
+			continue
+		}
+		dirPath := filepath.Dir(path)
+
+		bill, err := LoadBill(dirPath)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+
+		if !filter.matches(bill) {
+			continue
+		}
+
+		entry := billEntry{
+			Bill:      bill,
+			DirPath:   dirPath,
+			Documents: []billFile{},
+		}
+
+		for _, doc := range bill.Documents {
+			f, err := os.Stat(filepath.Join(dirPath, doc.Filename))
+			if err != nil {
+				continue
+			}
+			entry.Documents = append(entry.Documents, billFile{Filename: doc.Filename, Size: f.Size()})
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		di, dj := entries[i].Bill.Date(), entries[j].Bill.Date()
+		if !di.Equal(dj) {
+			return di.After(dj)
+		}
+		return entries[i].DirPath > entries[j].DirPath
+	})
+
+	return entries
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	text := r.URL.Query().Get(key)
+	if len(text) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(text)
+	if err != nil || n < 1 {
+		return 0, badRequest(errors.New(fmt.Sprintf("Invalid %s: %s", key, text)))
+	}
+	return n, nil
+}
+
+func queryDate(r *http.Request, key string) (time.Time, error) {
+	text := r.URL.Query().Get(key)
+	if len(text) == 0 {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse("2006-01-02", text)
+	if err != nil {
+		return date, badRequest(errors.New(fmt.Sprintf("Invalid %s: %s", key, text)))
+	}
+	return date, nil
+}
+
+// listBillsHandler serves a page of bills, such as
+// /bills?from=2016-01-01&to=2016-03-31&account=Expenses:Coffee&page=2
+//
+// Uses globals: config
+func listBillsHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var filter billFilter
+
+	if filter.From, err = queryDate(r, "from"); err != nil {
+		sendError(w, err)
+		return
+	}
+	if filter.To, err = queryDate(r, "to"); err != nil {
+		sendError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	filter.Account = q.Get("account")
+	filter.Payee = q.Get("payee")
+	filter.Tag = q.Get("tag")
+	filter.Link = q.Get("link")
+
+	page, err := queryInt(r, "page", 1)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	perPage, err := queryInt(r, "per_page", 50)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	if perPage > 500 {
+		perPage = 500
+	}
+
+	entries := config.listBills(filter)
+
+	// past the last page is empty, checked before multiplying a huge page
+	start := len(entries)
+	if page-1 < (len(entries)+perPage-1)/perPage {
+		start = (page - 1) * perPage
+	}
+	end := start + perPage
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	data := make(map[string]interface{})
+	data["bills"] = entries[start:end]
+	data["total"] = len(entries)
+	data["page"] = page
+	data["per_page"] = perPage
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
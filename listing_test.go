@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	s "strings"
+	"testing"
+)
+
+func TestListBills(t *testing.T) {
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	bills := []Bill{
+		Bill{
+			Transactions: []Transaction{
+				Transaction{
+					Date:      isodate("2016-02-12"),
+					Payee:     "Café de João",
+					Narration: "coffee",
+					Tags:      []string{"#coffee"},
+					Postings: []Posting{
+						Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+						Posting{Account: "Expenses:Food:Coffee"},
+					},
+				},
+			},
+			Documents: []Document{Document{Filename: "bill-one.png"}},
+		},
+		Bill{
+			Transactions: []Transaction{
+				Transaction{
+					Date:      isodate("2016-03-01"),
+					Payee:     "IKEA",
+					Narration: "cupboard",
+					Links:     []string{"^flat"},
+					Postings: []Posting{
+						Posting{Account: "Assets:Bank:Checking", Amount: dec("-55.95"), Currency: "EUR"},
+						Posting{Account: "Expenses:Home"},
+					},
+				},
+			},
+		},
+	}
+
+	for _, bill := range bills {
+		bill.StagingDir = "./testdata"
+		if err := bill.Save(config); err != nil {
+			t.Fatalf("hey: %v", err)
+		}
+	}
+
+	entries := config.listBills(billFilter{})
+	if len(entries) != 2 || entries[0].Bill.Transactions[0].Payee != "IKEA" {
+		t.Fatalf("hey: %v", entries)
+	}
+	if len(entries[1].Documents) != 1 || entries[1].Documents[0].Size == 0 {
+		t.Errorf("hey: %v", entries[1].Documents)
+	}
+
+	var filters = map[string]billFilter{
+		"Café de João": billFilter{Account: "Expenses:Food"},
+		"IKEA":         billFilter{From: isodate("2016-02-13")},
+		"ikea":         billFilter{Payee: "ike", Link: "flat"},
+	}
+
+	for payee, filter := range filters {
+		entries = config.listBills(filter)
+		if len(entries) != 1 || s.ToLower(entries[0].Bill.Transactions[0].Payee) != s.ToLower(payee) {
+			t.Errorf("hey: %v %v", filter, entries)
+		}
+	}
+
+	if entries = config.listBills(billFilter{Tag: "#tea"}); len(entries) != 0 {
+		t.Errorf("hey: %v", entries)
+	}
+
+	// past the last page, even one which overflows when multiplied
+	for _, page := range []string{"2", "9223372036854775807"} {
+		w := httptest.NewRecorder()
+		listBillsHandler(w, httptest.NewRequest("GET", "/bills?per_page=2&page="+page, nil))
+		var data struct {
+			Bills []billEntry `json:"bills"`
+			Total int         `json:"total"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&data); err != nil || len(data.Bills) != 0 || data.Total != 2 {
+			t.Errorf("hey: %s %v %v", page, data, err)
+		}
+	}
+}
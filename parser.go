@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	s "strings"
+	"time"
+)
+
+// Directives which have no Bill counterpart but are needed by the
+// completions, includes and validation tooling.
+
+type Open struct {
+	Date       time.Time `json:"date"`
+	Account    string    `json:"account"`
+	Currencies []string  `json:"currencies"`
+	Booking    string    `json:"booking"`
+}
+
+type Close struct {
+	Date    time.Time `json:"date"`
+	Account string    `json:"account"`
+}
+
+type Pad struct {
+	Date          time.Time `json:"date"`
+	Account       string    `json:"account"`
+	SourceAccount string    `json:"source_account"`
+}
+
+type Price struct {
+	Date          time.Time `json:"date"`
+	Currency      string    `json:"currency"`
+	Amount        Decimal   `json:"amount"`
+	QuoteCurrency string    `json:"quote_currency"`
+}
+
+type Commodity struct {
+	Date     time.Time `json:"date"`
+	Currency string    `json:"currency"`
+}
+
+type Option struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Include struct {
+	Path string `json:"path"`
+}
+
+// Ledger holds every directive parsed from a beancount file, in file order
+// per directive type.
+type Ledger struct {
+	Transactions []Transaction
+	Balances     []Balance
+	Pads         []Pad
+	Notes        []Note
+	Documents    []Document
+	Opens        []Open
+	Closes       []Close
+	Prices       []Price
+	Commodities  []Commodity
+	Options      []Option
+	Includes     []Include
+}
+
+type ParseError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e ParseError) Error() string {
+	if len(e.File) > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ParseErrors collects every error of a file, parsing continues with the
+// next directive after an error.
+type ParseErrors []ParseError
+
+func (errs ParseErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return s.Join(msgs, "\n")
+}
+
+var (
+	dateRe      = regexp.MustCompile(`^\d{4}[-/]\d{2}[-/]\d{2}$`)
+	accountRe   = regexp.MustCompile(`^[\p{Lu}][\p{L}\p{N}-]*(:[\p{Lu}\p{N}][\p{L}\p{N}-]*)+$`)
+	currencyRe  = regexp.MustCompile(`^[A-Z][A-Z0-9'._-]*$`)
+	numberRe    = regexp.MustCompile(`^[+-]?([0-9][0-9,]*)?(\.[0-9]*)?$`)
+	metaKeyRe   = regexp.MustCompile(`^[a-z][A-Za-z0-9_-]*:$`)
+	tagRe       = regexp.MustCompile(`^#[\p{L}\p{N}_/.-]+$`)
+	linkRe      = regexp.MustCompile(`^\^[\p{L}\p{N}_/.-]+$`)
+	txnFlagRe   = regexp.MustCompile(`^([*!&#?%PSTCURM]|txn)$`)
+	postingFlag = regexp.MustCompile(`^[*!&#?%PSTCURM]$`)
+)
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeLine splits a line on whitespace, keeping quoted strings and
+// {cost} specs as single tokens, and drops the trailing comment.
+func tokenizeLine(line string) ([]token, error) {
+	var tokens []token
+	runes := []rune(line)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			return tokens, nil
+		case c == '"':
+			var str []rune
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				str = append(str, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			tokens = append(tokens, token{text: string(str), quoted: true})
+		case c == '{':
+			j := i
+			for ; j < len(runes) && runes[j] != '}'; j++ {
+			}
+			for ; j < len(runes) && runes[j] == '}'; j++ {
+			}
+			if runes[j-1] != '}' {
+				return nil, errors.New("unterminated cost")
+			}
+			tokens = append(tokens, token{text: string(runes[i:j])})
+			i = j
+		default:
+			j := i
+			for ; j < len(runes) && runes[j] != ' ' && runes[j] != '\t' && runes[j] != '\r' && runes[j] != '"' && runes[j] != ';'; j++ {
+			}
+			tokens = append(tokens, token{text: string(runes[i:j])})
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+func parseDate(text string) (time.Time, error) {
+	return time.Parse("2006-01-02", s.Replace(text, "/", "-", -1))
+}
+
+// Beancount numbers may have thousands commas.
+func parseNumber(text string) (Decimal, error) {
+	if !numberRe.MatchString(text) || !s.ContainsAny(text, "0123456789") {
+		return Decimal{}, errors.New(fmt.Sprintf("invalid number: %s", text))
+	}
+	return ParseDecimal(s.Replace(text, ",", "", -1))
+}
+
+func isNumber(text string) bool {
+	return numberRe.MatchString(text) && s.ContainsAny(text, "0123456789")
+}
+
+func (tok token) isBare(re *regexp.Regexp) bool {
+	return !tok.quoted && re.MatchString(tok.text)
+}
+
+// metaValueFmt renders a parsed metadata value back as beancount.
+func metaValueFmt(tokens []token) string {
+	var parts []string
+	for _, tok := range tokens {
+		if tok.quoted {
+			parts = append(parts, strconv.Quote(tok.text))
+		} else {
+			parts = append(parts, tok.text)
+		}
+	}
+	return s.Join(parts, " ")
+}
+
+type beancountParser struct {
+	file   string
+	ledger Ledger
+	errs   ParseErrors
+
+	// the transaction being read, its postings and metadata follow on
+	// indented lines
+	txn           *Transaction
+	postingIndent int
+	// indented lines of a directive which failed to parse are skipped
+	skipping bool
+	// metadata of other directives is accepted but not kept
+	inDirective bool
+
+	pads     []Pad
+	pushTags []string
+}
+
+func (p *beancountParser) errorf(line int, format string, args ...interface{}) {
+	p.errs = append(p.errs, ParseError{File: p.file, Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *beancountParser) finishEntry() {
+	if p.txn != nil {
+		p.ledger.Transactions = append(p.ledger.Transactions, *p.txn)
+		p.txn = nil
+	}
+	p.skipping = false
+	p.inDirective = false
+}
+
+// ParseBeancount parses beancount text. On errors the directives which could
+// be parsed are still returned along with ParseErrors.
+func ParseBeancount(text string) (Ledger, error) {
+	return parseBeancount("", text)
+}
+
+func ParseBeancountFile(path string) (Ledger, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Ledger{}, err
+	}
+	return parseBeancount(path, string(content))
+}
+
+func parseBeancount(file string, text string) (Ledger, error) {
+	p := beancountParser{file: file}
+
+	for i, line := range s.Split(text, "\n") {
+		p.parseLine(i+1, line)
+	}
+	p.finishEntry()
+
+	// pads which weren't merged into a balance of the same date
+	p.ledger.Pads = append(p.ledger.Pads, p.pads...)
+
+	if len(p.errs) > 0 {
+		return p.ledger, p.errs
+	}
+	return p.ledger, nil
+}
+
+func (p *beancountParser) parseLine(lineNum int, line string) {
+	tokens, err := tokenizeLine(line)
+	if err != nil {
+		p.errorf(lineNum, "%v", err)
+		return
+	}
+
+	// blank and comment lines don't end a transaction
+	if len(tokens) == 0 {
+		return
+	}
+
+	indent := len(line) - len(s.TrimLeft(line, " \t"))
+
+	if indent > 0 {
+		if p.skipping {
+			return
+		}
+		if p.txn == nil {
+			if !p.inDirective || !tokens[0].isBare(metaKeyRe) {
+				p.errorf(lineNum, "unexpected indented line")
+			}
+			return
+		}
+		p.parseTxnLine(lineNum, indent, tokens)
+		return
+	}
+
+	p.finishEntry()
+
+	// org-mode and markdown headers, and other non-directive lines
+	// beancount ignores
+	if s.ContainsAny(line[:1], "*#:!&?%") {
+		return
+	}
+
+	if err = p.parseDirective(lineNum, tokens); err != nil {
+		p.errorf(lineNum, "%v", err)
+		p.txn = nil
+		p.skipping = true
+		return
+	}
+	p.inDirective = true
+}
+
+func (p *beancountParser) parseDirective(lineNum int, tokens []token) error {
+	if !tokens[0].isBare(dateRe) {
+		return p.parseUndated(tokens)
+	}
+
+	date, err := parseDate(tokens[0].text)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid date: %s", tokens[0].text))
+	}
+	if len(tokens) < 2 {
+		return errors.New("missing directive")
+	}
+
+	keyword := tokens[1].text
+	args := tokens[2:]
+
+	if tokens[1].quoted {
+		return errors.New(fmt.Sprintf("unexpected string: %q", keyword))
+	}
+
+	if txnFlagRe.MatchString(keyword) {
+		return p.parseTxnHeader(date, keyword, args)
+	}
+
+	account := ""
+	if len(args) > 0 && args[0].isBare(accountRe) {
+		account = args[0].text
+	}
+
+	switch keyword {
+	case "open":
+		if len(account) == 0 {
+			return errors.New("open: missing account")
+		}
+		open := Open{Date: date, Account: account}
+		for _, tok := range args[1:] {
+			if tok.quoted {
+				open.Booking = tok.text
+				continue
+			}
+			for _, cur := range s.Split(tok.text, ",") {
+				if len(cur) == 0 {
+					continue
+				}
+				if !currencyRe.MatchString(cur) {
+					return errors.New(fmt.Sprintf("open: invalid currency: %s", cur))
+				}
+				open.Currencies = append(open.Currencies, cur)
+			}
+		}
+		p.ledger.Opens = append(p.ledger.Opens, open)
+
+	case "close":
+		if len(account) == 0 || len(args) != 1 {
+			return errors.New("close: expected an account")
+		}
+		p.ledger.Closes = append(p.ledger.Closes, Close{Date: date, Account: account})
+
+	case "commodity":
+		if len(args) != 1 || !args[0].isBare(currencyRe) {
+			return errors.New("commodity: expected a currency")
+		}
+		p.ledger.Commodities = append(p.ledger.Commodities, Commodity{Date: date, Currency: args[0].text})
+
+	case "balance":
+		// an optional tolerance is accepted but not kept
+		if len(account) == 0 || (len(args) != 3 && len(args) != 5) {
+			return errors.New("balance: expected an account, amount and currency")
+		}
+		amount, err := parseNumber(args[1].text)
+		if err != nil {
+			return err
+		}
+		cur := args[len(args)-1]
+		if !cur.isBare(currencyRe) {
+			return errors.New(fmt.Sprintf("balance: invalid currency: %s", cur.text))
+		}
+		bal := Balance{
+			Date:          date,
+			Amount:        amount,
+			Currency:      cur.text,
+			SourceAccount: account,
+		}
+		for i, pad := range p.pads {
+			if pad.Account == account && pad.Date.Equal(date) {
+				bal.Padded = true
+				bal.TargetAccount = pad.SourceAccount
+				p.pads = append(p.pads[:i], p.pads[i+1:]...)
+				break
+			}
+		}
+		p.ledger.Balances = append(p.ledger.Balances, bal)
+
+	case "pad":
+		if len(account) == 0 || len(args) != 2 || !args[1].isBare(accountRe) {
+			return errors.New("pad: expected two accounts")
+		}
+		p.pads = append(p.pads, Pad{Date: date, Account: account, SourceAccount: args[1].text})
+
+	case "note":
+		if len(account) == 0 || len(args) != 2 || !args[1].quoted {
+			return errors.New("note: expected an account and a description")
+		}
+		p.ledger.Notes = append(p.ledger.Notes, Note{Date: date, Account: account, Description: args[1].text})
+
+	case "document":
+		if len(account) == 0 || len(args) < 2 || !args[1].quoted {
+			return errors.New("document: expected an account and a path")
+		}
+		p.ledger.Documents = append(p.ledger.Documents, Document{Date: date, Account: account, Filename: args[1].text})
+
+	case "price":
+		if len(args) != 3 || !args[0].isBare(currencyRe) || !args[2].isBare(currencyRe) {
+			return errors.New("price: expected a currency, amount and currency")
+		}
+		amount, err := parseNumber(args[1].text)
+		if err != nil {
+			return err
+		}
+		p.ledger.Prices = append(p.ledger.Prices, Price{
+			Date:          date,
+			Currency:      args[0].text,
+			Amount:        amount,
+			QuoteCurrency: args[2].text,
+		})
+
+	case "event", "query", "custom":
+		// valid, but not used here
+
+	default:
+		return errors.New(fmt.Sprintf("unknown directive: %s", keyword))
+	}
+
+	return nil
+}
+
+func (p *beancountParser) parseUndated(tokens []token) error {
+	keyword := tokens[0].text
+	args := tokens[1:]
+
+	if tokens[0].quoted {
+		return errors.New(fmt.Sprintf("unexpected string: %q", keyword))
+	}
+
+	switch keyword {
+	case "option":
+		if len(args) != 2 || !args[0].quoted || !args[1].quoted {
+			return errors.New("option: expected a name and a value")
+		}
+		p.ledger.Options = append(p.ledger.Options, Option{Name: args[0].text, Value: args[1].text})
+
+	case "include":
+		if len(args) != 1 || !args[0].quoted {
+			return errors.New("include: expected a path")
+		}
+		p.ledger.Includes = append(p.ledger.Includes, Include{Path: args[0].text})
+
+	case "pushtag", "poptag":
+		if len(args) != 1 || !args[0].isBare(tagRe) {
+			return errors.New(fmt.Sprintf("%s: expected a tag", keyword))
+		}
+		if keyword == "pushtag" {
+			p.pushTags = append(p.pushTags, args[0].text)
+			return nil
+		}
+		for i, tag := range p.pushTags {
+			if tag == args[0].text {
+				p.pushTags = append(p.pushTags[:i], p.pushTags[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("poptag: tag was not pushed: %s", args[0].text))
+
+	case "plugin":
+		// valid, but not used here
+
+	default:
+		return errors.New(fmt.Sprintf("unexpected: %s", keyword))
+	}
+
+	return nil
+}
+
+func (p *beancountParser) parseTxnHeader(date time.Time, flag string, args []token) error {
+	txn := Transaction{Date: date}
+	if flag != "txn" {
+		txn.Flag = flag
+	}
+
+	var strs []string
+	for _, tok := range args {
+		switch {
+		case tok.quoted:
+			if len(txn.Tags) > 0 || len(txn.Links) > 0 || len(strs) == 2 {
+				return errors.New(fmt.Sprintf("unexpected string: %q", tok.text))
+			}
+			strs = append(strs, tok.text)
+		case tok.text == "|" && len(strs) == 1:
+			// the old payee | narration separator, Fava still writes it
+		case tagRe.MatchString(tok.text):
+			txn.Tags = append(txn.Tags, tok.text)
+		case linkRe.MatchString(tok.text):
+			txn.Links = append(txn.Links, tok.text)
+		default:
+			return errors.New(fmt.Sprintf("unexpected: %s", tok.text))
+		}
+	}
+
+	switch len(strs) {
+	case 1:
+		txn.Narration = strs[0]
+	case 2:
+		txn.Payee = strs[0]
+		txn.Narration = strs[1]
+	}
+
+	for _, tag := range p.pushTags {
+		txn.Tags = append(txn.Tags, tag)
+	}
+	txn.Tags = UniqStrOrdered(txn.Tags)
+
+	p.txn = &txn
+	return nil
+}
+
+// parseTxnLine reads the indented postings and metadata of a transaction.
+func (p *beancountParser) parseTxnLine(lineNum int, indent int, tokens []token) {
+	txn := p.txn
+
+	if tokens[0].isBare(metaKeyRe) {
+		entry := MetaEntry{
+			Key:   s.TrimSuffix(tokens[0].text, ":"),
+			Value: metaValueFmt(tokens[1:]),
+		}
+		// deeper than the last posting belongs to the posting
+		if len(txn.Postings) > 0 && indent > p.postingIndent {
+			last := &txn.Postings[len(txn.Postings)-1]
+			last.Meta = append(last.Meta, entry)
+		} else if len(txn.Postings) > 0 {
+			p.errorf(lineNum, "transaction metadata after postings")
+		} else {
+			txn.Meta = append(txn.Meta, entry)
+		}
+		return
+	}
+
+	posting, err := parsePosting(tokens)
+	if err != nil {
+		p.errorf(lineNum, "%v", err)
+		return
+	}
+	p.postingIndent = indent
+	txn.Postings = append(txn.Postings, posting)
+}
+
+func parsePosting(tokens []token) (Posting, error) {
+	var posting Posting
+
+	if tokens[0].isBare(postingFlag) {
+		posting.Flag = tokens[0].text
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) == 0 || !tokens[0].isBare(accountRe) {
+		return posting, errors.New("invalid posting: expected an account")
+	}
+	posting.Account = tokens[0].text
+	tokens = tokens[1:]
+
+	if len(tokens) > 0 && !tokens[0].quoted && isNumber(tokens[0].text) {
+		amount, err := parseNumber(tokens[0].text)
+		if err != nil {
+			return posting, err
+		}
+		posting.Amount = amount
+		tokens = tokens[1:]
+
+		if len(tokens) > 0 && tokens[0].isBare(currencyRe) {
+			posting.Currency = tokens[0].text
+			tokens = tokens[1:]
+		}
+	}
+
+	if len(tokens) > 0 && !tokens[0].quoted && s.HasPrefix(tokens[0].text, "{") {
+		posting.Cost = tokens[0].text
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) > 0 && !tokens[0].quoted && (tokens[0].text == "@" || tokens[0].text == "@@") {
+		if len(tokens) != 3 || !isNumber(tokens[1].text) || !tokens[2].isBare(currencyRe) {
+			return posting, errors.New("invalid posting: expected a price amount and currency")
+		}
+		posting.Price = fmt.Sprintf("%s %s %s", tokens[0].text, tokens[1].text, tokens[2].text)
+		tokens = tokens[3:]
+	}
+
+	if len(tokens) > 0 {
+		return posting, errors.New(fmt.Sprintf("invalid posting: unexpected %s", tokens[0].text))
+	}
+
+	return posting, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseBeancountDirectives(t *testing.T) {
+	text := `;; -*- mode: beancount; -*-
+* Options
+
+option "title" "The Finances"
+option "operating_currency" "EUR"
+include "tools/tmp/includes.beancount"
+
+2013-12-01 open Assets:PT:Bank:Current EUR,USD
+2013-12-01 open Expenses:Coffee
+2013-12-01 commodity EUR
+2015-01-01 close Expenses:Coffee
+
+2016-02-12 * "Café de 'João'" | "dois \"X\" café" #coffee #portugal ^holiday-2016 ^trip ; comment
+  receipt: "A-1234"
+  Assets:PT:Bank:Current  -5.50 EUR
+    fitid: "XYZ"
+  ! Expenses:Coffee        1,000.00 EUR @ 1.10 USD
+  Expenses:Tips
+
+2016-03-21 pad Assets:PT:Bank:Current Equity:Opening-Balances
+2016-03-21 balance Assets:PT:Bank:Current 324.25 EUR
+2016-03-22 note Assets:PT:Bank:Current "called the bank"
+2016-03-23 document Assets:PT:Bank:Current "scan.pdf"
+2016-03-24 price USD 0.90 EUR
+`
+
+	ledger, err := ParseBeancount(text)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if len(ledger.Options) != 2 || ledger.Options[1].Value != "EUR" {
+		t.Errorf("hey: %v", ledger.Options)
+	}
+	if len(ledger.Includes) != 1 || ledger.Includes[0].Path != "tools/tmp/includes.beancount" {
+		t.Errorf("hey: %v", ledger.Includes)
+	}
+	if len(ledger.Opens) != 2 || len(ledger.Opens[0].Currencies) != 2 || len(ledger.Closes) != 1 || len(ledger.Commodities) != 1 {
+		t.Errorf("hey: %v %v", ledger.Opens, ledger.Closes)
+	}
+
+	if len(ledger.Transactions) != 1 {
+		t.Fatalf("hey: %v", ledger.Transactions)
+	}
+	txn := ledger.Transactions[0]
+	switch {
+	case txn.Payee != "Café de 'João'",
+		txn.Narration != `dois "X" café`,
+		len(txn.Tags) != 2,
+		len(txn.Links) != 2 || txn.Links[1] != "^trip",
+		txn.Meta.Get("receipt") != "A-1234",
+		len(txn.Postings) != 3,
+		txn.Postings[0].Amount.String() != "-5.50",
+		txn.Postings[0].Meta.Get("fitid") != "XYZ",
+		txn.Postings[1].Flag != "!",
+		txn.Postings[1].Amount.String() != "1000.00",
+		txn.Postings[1].Price != "@ 1.10 USD",
+		!txn.Postings[2].Amount.IsZero():
+		t.Errorf("hey: %v", txn)
+	}
+
+	if len(ledger.Balances) != 1 || !ledger.Balances[0].Padded || ledger.Balances[0].TargetAccount != "Equity:Opening-Balances" || len(ledger.Pads) != 0 {
+		t.Errorf("hey: %v", ledger.Balances)
+	}
+	if len(ledger.Notes) != 1 || len(ledger.Documents) != 1 || ledger.Documents[0].Filename != "scan.pdf" {
+		t.Errorf("hey: %v %v", ledger.Notes, ledger.Documents)
+	}
+	if len(ledger.Prices) != 1 || ledger.Prices[0].Amount.String() != "0.90" {
+		t.Errorf("hey: %v", ledger.Prices)
+	}
+}
+
+func TestParseBeancountRoundTrip(t *testing.T) {
+	text := `2016-02-12 * "Café de 'João'" | "dois café" #coffee ^holiday-2016 ^trip
+  receipt: "A-1234"
+  Assets:PT:Bank:Current  -5.50 EUR
+    fitid: "XYZ"
+  Expenses:Coffee` + "         "
+
+	ledger, _ := ParseBeancount(text)
+	if len(ledger.Transactions) != 1 {
+		t.Fatalf("hey: %v", ledger)
+	}
+	if res := ledger.Transactions[0].String(); res != text {
+		t.Errorf("hey: %s", res)
+	}
+}
+
+func TestParseBeancountErrors(t *testing.T) {
+	text := `2016-02-12 * "ok"
+  Assets:Bank  -5.50 EUR
+  Expenses:Coffee
+
+2016-02-13 * "bad amount"
+  Assets:Bank  -5.5x EUR
+
+2016-02-14 opne Assets:Bank
+2016-02-15 * "unterminated
+`
+
+	ledger, err := ParseBeancount(text)
+
+	errs, ok := err.(ParseErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("hey: %v", err)
+	}
+	if errs[0].Line != 6 || errs[1].Line != 8 || errs[2].Line != 9 {
+		t.Errorf("hey: %v", errs)
+	}
+	if len(ledger.Transactions) != 2 {
+		t.Errorf("hey: %v", ledger.Transactions)
+	}
+}
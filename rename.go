@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	s "strings"
+)
+
+// Accounts are renamed with their sub-accounts in the bills and in the main
+// beancount file with the files it includes. Strings and comments are left
+// as they are.
+
+// rewriteWords replaces the words of beancount text outside of strings and
+// comments, and returns how many it replaced. rename returns the new word,
+// and false to keep the word. Tags and links are only kept once per line, for
+// merging them.
+func rewriteWords(text string, rename func(word string) (string, bool)) (string, int) {
+	var out []rune
+	count := 0
+	runes := []rune(text)
+	lineStart := true
+	// the tags and links of the line, true when renamed
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+
+		// org-mode headings and comments run to the end of the line
+		if (lineStart && c == '*') || c == ';' {
+			j := i
+			for ; j < len(runes) && runes[j] != '\n'; j++ {
+			}
+			out = append(out, runes[i:j]...)
+			i = j
+			lineStart = false
+			continue
+		}
+
+		switch {
+		case c == '\n':
+			out = append(out, c)
+			i++
+			lineStart = true
+			seen = make(map[string]bool)
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			out = append(out, c)
+			i++
+		case c == '"':
+			// strings can span lines
+			j := i + 1
+			for ; j < len(runes) && runes[j] != '"'; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+			}
+			if j < len(runes) {
+				j++
+			}
+			out = append(out, runes[i:j]...)
+			i = j
+		default:
+			j := i
+			for ; j < len(runes) && !s.ContainsRune(" \t\r\n\";", runes[j]); j++ {
+			}
+			word := string(runes[i:j])
+			i = j
+
+			renamed, ok := rename(word)
+			if !ok {
+				renamed = word
+			}
+
+			if s.HasPrefix(renamed, "#") || s.HasPrefix(renamed, "^") {
+				if wasRenamed, dup := seen[renamed]; dup && (ok || wasRenamed) {
+					// drop the repeated tag with the space before it
+					for len(out) > 0 && (out[len(out)-1] == ' ' || out[len(out)-1] == '\t') {
+						out = out[:len(out)-1]
+					}
+					count++
+					break
+				}
+				seen[renamed] = seen[renamed] || ok
+			}
+
+			out = append(out, []rune(renamed)...)
+			if !ok {
+				break
+			}
+			count++
+
+			// keep the amount after the account in its column
+			k := i
+			for ; k < len(runes) && runes[k] == ' '; k++ {
+			}
+			spaces := k - i
+			if spaces >= 2 && k < len(runes) && runes[k] != '\n' && runes[k] != '\r' && runes[k] != ';' {
+				spaces -= len([]rune(renamed)) - len([]rune(word))
+				if spaces < 2 {
+					spaces = 2
+				}
+				out = append(out, []rune(s.Repeat(" ", spaces))...)
+				i = k
+			}
+		}
+		lineStart = false
+	}
+
+	return string(out), count
+}
+
+// inAccount is true for the account and its sub-accounts.
+func inAccount(account string, parent string) bool {
+	return account == parent || s.HasPrefix(account, parent+":")
+}
+
+// renameAccountText renames the account and its sub-accounts wherever they
+// are a word of their own, and returns how many times.
+func renameAccountText(text string, oldAccount string, newAccount string) (string, int) {
+	return rewriteWords(text, func(word string) (string, bool) {
+		if inAccount(word, oldAccount) {
+			return newAccount + word[len(oldAccount):], true
+		}
+		return word, false
+	})
+}
+
+// renamedAccounts lists the new names of the accounts the text renames.
+func renamedAccounts(text string, oldAccount string, newAccount string) []string {
+	var accounts []string
+	rewriteWords(text, func(word string) (string, bool) {
+		if inAccount(word, oldAccount) {
+			accounts = append(accounts, newAccount+word[len(oldAccount):])
+		}
+		return word, false
+	})
+	return accounts
+}
+
+// uniquePaths drops the paths of files already in the list, such as a bill
+// file the main file includes directly.
+func uniquePaths(paths []string) []string {
+	var unique []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			abs = path
+		}
+		if !seen[abs] {
+			seen[abs] = true
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+type renamedFile struct {
+	path    string
+	oldText string
+	newText string
+	count   int
+}
+
+// diff prints the changed lines, the renaming doesn't add or remove lines.
+func (f renamedFile) diff(w io.Writer) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", f.path, f.path)
+	oldLines := s.Split(f.oldText, "\n")
+	newLines := s.Split(f.newText, "\n")
+	for i := range oldLines {
+		if i < len(newLines) && oldLines[i] != newLines[i] {
+			fmt.Fprintf(w, "@@ -%d +%d @@\n-%s\n+%s\n", i+1, i+1, oldLines[i], newLines[i])
+		}
+	}
+}
+
+// renameAccount renames the account in every beancount file, the bills in the
+// trash as well, so that they can be restored. A sub-account can't get the
+// name of an open account, such as Expenses:Food:Coffee when renaming
+// Expenses:Food to Expenses:Drinks and Expenses:Drinks:Coffee is open.
+//
+// Every file is renamed in memory first. With dryRun the files are not
+// written. When writing a file fails, the files written before are written
+// back.
+func (c conf) renameAccount(oldAccount string, newAccount string, dryRun bool) ([]renamedFile, error) {
+	var files []renamedFile
+
+	for _, account := range []string{oldAccount, newAccount} {
+		if !accountRe.MatchString(account) {
+			return files, badRequest(errors.New(fmt.Sprintf("Not an account name: %q", account)))
+		}
+	}
+	if oldAccount == newAccount {
+		return files, badRequest(errors.New("The new account name is the same"))
+	}
+
+	idx, err := c.loadLedgerIndex()
+	if err != nil {
+		return files, err
+	}
+	var paths []string
+	c.walkLedgerFiles(func(path string, ledger Ledger) {
+		paths = append(paths, path)
+	})
+	paths = append(paths, c.billFilePaths()...)
+	paths = append(paths, billFilePathsIn(c.TrashFolder)...)
+
+	// the new names of the accounts renamed, with the old ones' opens
+	renamed := make(map[string]bool)
+	for account := range idx.opens {
+		if inAccount(account, oldAccount) {
+			renamed[newAccount+account[len(oldAccount):]] = true
+		}
+	}
+
+	for _, path := range uniquePaths(paths) {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return files, err
+		}
+		text, count := renameAccountText(string(content), oldAccount, newAccount)
+		if count > 0 {
+			files = append(files, renamedFile{path: path, oldText: string(content), newText: text, count: count})
+			for _, account := range renamedAccounts(string(content), oldAccount, newAccount) {
+				renamed[account] = true
+			}
+		}
+	}
+
+	// renamed into an account which stays, such as Expenses:Food:Coffee
+	// renamed to Expenses:Food:Coffee:Coffee, is no clash
+	var taken []string
+	for account := range renamed {
+		if _, ok := idx.opens[account]; ok && !inAccount(account, oldAccount) {
+			taken = append(taken, account)
+		}
+	}
+	if len(taken) > 0 {
+		sort.Strings(taken)
+		return nil, conflict(errors.New(fmt.Sprintf("Already open: %s", s.Join(taken, ", "))))
+	}
+
+	if len(files) == 0 {
+		return files, badRequest(errors.New(fmt.Sprintf("Account %s is not used anywhere", oldAccount)))
+	}
+
+	if dryRun {
+		return files, nil
+	}
+
+	for i, f := range files {
+		if err := writeFileAtomic(f.path, []byte(f.newText)); err != nil {
+			return renameFailed(files[:i], f.path, err)
+		}
+	}
+
+	return files, c.updateIncludesBeancountFile()
+}
+
+// renameFailed writes back the files renamed before writing path failed, and
+// returns the ones which could not be written back.
+func renameFailed(written []renamedFile, path string, err error) ([]renamedFile, error) {
+	var left []renamedFile
+	var leftPaths []string
+	for _, f := range written {
+		if werr := writeFileAtomic(f.path, []byte(f.oldText)); werr != nil {
+			left = append(left, f)
+			leftPaths = append(leftPaths, f.path)
+		}
+	}
+	if len(left) > 0 {
+		return left, errors.New(fmt.Sprintf("Could not write %s: %v, and could not write back: %s", path, err, s.Join(leftPaths, ", ")))
+	}
+	return nil, errors.New(fmt.Sprintf("Could not write %s: %v, nothing was renamed", path, err))
+}
+
+// uses globals: config
+func actionRenameAccount(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Usage: rename-account [--dry-run] OLD NEW", 1)
+	}
+
+	files, err := config.renameAccount(c.Args().Get(0), c.Args().Get(1), c.Bool("dry-run"))
+	if c.Bool("dry-run") {
+		for _, f := range files {
+			f.diff(os.Stdout)
+		}
+	} else {
+		for _, f := range files {
+			fmt.Printf("Renamed %d times: %s\n", f.count, f.path)
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+func TestRenameAccountText(t *testing.T) {
+	text := `* Expenses:Food heading
+2016-01-01 open Expenses:Food
+2016-01-01 open Expenses:Food:Restaurant
+2016-01-01 open Expenses:FoodTruck
+
+2016-02-12 * "Expenses:Food in a string" "multi
+line Expenses:Food"
+  account: Expenses:Food
+  Expenses:Food:Restaurant  12.00 EUR ; Expenses:Food in a comment
+  Assets:Cash
+
+2016-02-13 balance Expenses:Food 0 EUR
+`
+	expect := `* Expenses:Food heading
+2016-01-01 open Expenses:Groceries
+2016-01-01 open Expenses:Groceries:Restaurant
+2016-01-01 open Expenses:FoodTruck
+
+2016-02-12 * "Expenses:Food in a string" "multi
+line Expenses:Food"
+  account: Expenses:Groceries
+  Expenses:Groceries:Restaurant  12.00 EUR ; Expenses:Food in a comment
+  Assets:Cash
+
+2016-02-13 balance Expenses:Groceries 0 EUR
+`
+
+	res, count := renameAccountText(text, "Expenses:Food", "Expenses:Groceries")
+	if res != expect || count != 5 {
+		t.Errorf("hey: %d\n%s", count, res)
+	}
+
+	// the amounts stay in their column
+	res, _ = renameAccountText("  Expenses:Food:Restaurant  12.00 EUR\n  Assets:Cash              -12.00 EUR\n", "Assets:Cash", "Assets:Wallet")
+	if expect = "  Expenses:Food:Restaurant  12.00 EUR\n  Assets:Wallet            -12.00 EUR\n"; res != expect {
+		t.Errorf("hey: %s", res)
+	}
+}
+
+func TestRenameAccount(t *testing.T) {
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Payee:     "Cafe Jao",
+				Narration: "coffee",
+				Postings: []Posting{
+					Posting{Account: "Expenses:Food:Coffee", Amount: dec("5.50"), Currency: "EUR"},
+					Posting{Account: "Assets:Cash"},
+				},
+			},
+		},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.MainBeancountFile = "./testbills/main.beancount"
+	config.TrashFolder = "./testtrash"
+	defer os.RemoveAll(config.BillsFolder)
+	defer os.RemoveAll(config.TrashFolder)
+
+	// a deleted bill, which can be restored
+	trashed := bill
+	trashed.Transactions = []Transaction{bill.Transactions[0]}
+	trashed.Transactions[0].Narration = "cake"
+	if err := trashed.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	trashID, err := config.trashBill(trashed.DirPath)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	// the bill is included directly as well
+	main := "include \"includes.beancount\"\ninclude \"2016/*/*/bill.beancount\"\n\n2016-01-01 open Expenses:Food\n2016-01-01 open Assets:Cash\n2016-01-01 open Expenses:Treats:Coffee\n"
+	ioutil.WriteFile(config.MainBeancountFile, []byte(main), 0644)
+
+	if _, err := config.renameAccount("Expenses:Food", "Assets:Cash", false); err == nil {
+		t.Errorf("hey: renamed to an open account")
+	}
+	// Expenses:Food:Coffee would become the open Expenses:Treats:Coffee
+	if _, err := config.renameAccount("Expenses:Food", "Expenses:Treats", false); err == nil ||
+		!s.Contains(err.Error(), "Expenses:Treats:Coffee") {
+		t.Errorf("hey: %v", err)
+	}
+	if _, err := config.renameAccount("Expenses:Drinks", "Expenses:Coffee", false); err == nil {
+		t.Errorf("hey: renamed an unused account")
+	}
+
+	files, err := config.renameAccount("Expenses:Food", "Expenses:Groceries", true)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("hey: %v %v", files, err)
+	}
+	var diff bytes.Buffer
+	files[0].diff(&diff)
+	expect := "--- ./testbills/main.beancount\n+++ ./testbills/main.beancount\n@@ -4 +4 @@\n-2016-01-01 open Expenses:Food\n+2016-01-01 open Expenses:Groceries\n"
+	if diff.String() != expect {
+		t.Errorf("hey: %s", diff.String())
+	}
+	if text, _ := ioutil.ReadFile(config.MainBeancountFile); string(text) != main {
+		t.Errorf("hey: written in a dry run: %s", text)
+	}
+
+	if _, err = config.renameAccount("Expenses:Food", "Expenses:Groceries", false); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	text, _ := ioutil.ReadFile(filepath.Join(bill.DirPath, bill.BeancountFilename()))
+	if !s.Contains(string(text), "Expenses:Groceries:Coffee") || s.Contains(string(text), "Expenses:Food") {
+		t.Errorf("hey: %s", text)
+	}
+	text, _ = ioutil.ReadFile(config.MainBeancountFile)
+	if !s.Contains(string(text), "open Expenses:Groceries\n") {
+		t.Errorf("hey: %s", text)
+	}
+	text, _ = ioutil.ReadFile(filepath.Join(config.TrashFolder, trashID, bill.BeancountFilename()))
+	if !s.Contains(string(text), "Expenses:Groceries:Coffee") {
+		t.Errorf("hey: %s", text)
+	}
+}
+
+func TestRenameFailed(t *testing.T) {
+	os.MkdirAll("./testbills", 0755)
+	defer os.RemoveAll("./testbills")
+
+	ioutil.WriteFile("./testbills/a.beancount", []byte("Expenses:Groceries"), 0644)
+	written := []renamedFile{
+		renamedFile{path: "./testbills/a.beancount", oldText: "Expenses:Food", newText: "Expenses:Groceries"},
+	}
+
+	left, err := renameFailed(written, "./testbills/b.beancount", errors.New("disk full"))
+	if len(left) != 0 || err == nil || !s.Contains(err.Error(), "nothing was renamed") {
+		t.Errorf("hey: %v %v", left, err)
+	}
+	if text, _ := ioutil.ReadFile("./testbills/a.beancount"); string(text) != "Expenses:Food" {
+		t.Errorf("hey: %s", text)
+	}
+
+	// its folder is gone
+	written = append(written, renamedFile{path: "./testbills/gone/c.beancount", oldText: "Expenses:Food"})
+	left, err = renameFailed(written, "./testbills/b.beancount", errors.New("disk full"))
+	if len(left) != 1 || left[0].path != "./testbills/gone/c.beancount" || err == nil {
+		t.Errorf("hey: %v %v", left, err)
+	}
+}
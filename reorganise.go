@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	s "strings"
+)
+
+// Reorganising moves the saved bills to where the layout puts them now, after
+// the templates or the filename sanitising changed. Whole folders are moved,
+// so the documents in them stay next to their bill file. Document paths which
+// point out of a folder, or into a moved one, are rewritten.
+
+type billMove struct {
+	from string
+	to   string
+}
+
+// movedPath is where path is after the moves, as an absolute path. Paths are
+// compared absolute, a file can be reached through an absolute or a ../
+// include.
+func movedPath(path string, moves []billMove) string {
+	path, _ = filepath.Abs(path)
+	for _, m := range moves {
+		from, _ := filepath.Abs(m.from)
+		to, _ := filepath.Abs(m.to)
+		if path == from || s.HasPrefix(path, from+string(filepath.Separator)) {
+			return to + path[len(from):]
+		}
+	}
+	return path
+}
+
+// moveDocumentPaths rewrites the relative document paths of a beancount file
+// moved from oldPath to newPath, for the file and the documents being moved,
+// and returns how many it changed.
+func moveDocumentPaths(text string, oldPath string, newPath string, moves []billMove) (string, int) {
+	newDir, _ := filepath.Abs(filepath.Dir(newPath))
+	count := 0
+	out := documentDirectiveRe.ReplaceAllStringFunc(text, func(line string) string {
+		m := documentDirectiveRe.FindStringSubmatch(line)
+		filename, err := strconv.Unquote(m[2])
+		if err != nil || filepath.IsAbs(filename) {
+			return line
+		}
+		target := movedPath(filepath.Join(filepath.Dir(oldPath), filename), moves)
+		rel, err := filepath.Rel(newDir, target)
+		if err != nil || rel == filepath.Clean(filename) {
+			return line
+		}
+		count++
+		return fmt.Sprintf("%s%q", m[1], filepath.ToSlash(rel))
+	})
+	return out, count
+}
+
+// planReorganise lists the bills which are not in the folder the layout gives
+// them, and where they go. Bills which can't be read are returned as errors
+// and stay.
+func (c conf) planReorganise() ([]billMove, []error) {
+	var moves []billMove
+	var errs []error
+
+	// planned targets, which don't exist yet
+	taken := make(map[string]bool)
+
+	for _, path := range c.billFilePaths() {
+		// other beancount files are moved with the folder of their bill
+		if !isBillFile(path) {
+			continue
+		}
+		dirPath := filepath.Dir(path)
+
+		ledger, err := ParseBeancountFile(path)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %v", dirPath, err)))
+			continue
+		}
+		bill := Bill{
+			Transactions: ledger.Transactions,
+			Balances:     ledger.Balances,
+			Notes:        ledger.Notes,
+		}
+
+		target, err := c.layoutDirPath(bill)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %v", dirPath, err)))
+			continue
+		}
+
+		// as freeDirPath, with the planned targets taken as well
+		for n := 1; ; n++ {
+			candidate := target
+			if n > 1 {
+				candidate = fmt.Sprintf("%s _ %d", target, n)
+			}
+			if candidate == dirPath {
+				target = candidate
+				break
+			}
+			if ex, _ := exists(candidate); !ex && !taken[candidate] {
+				target = candidate
+				break
+			}
+			if n == 1000 {
+				errs = append(errs, errors.New(fmt.Sprintf("%s: No free folder for %s", dirPath, target)))
+				target = dirPath
+				break
+			}
+		}
+
+		if target != dirPath {
+			taken[target] = true
+			moves = append(moves, billMove{from: dirPath, to: target})
+		}
+	}
+
+	return moves, errs
+}
+
+// reorganise moves the bill folders and rewrites the document paths which
+// change, then the includes file. When a move fails, the paths are rewritten
+// for the moves done so far.
+func (c conf) reorganise(moves []billMove) error {
+	if len(moves) == 0 {
+		return nil
+	}
+
+	// where the files are before moving
+	var paths []string
+	c.walkLedgerFiles(func(path string, ledger Ledger) {
+		paths = append(paths, path)
+	})
+	paths = append(paths, c.billFilePaths()...)
+	paths = uniquePaths(paths)
+
+	done := 0
+	var moveErr error
+	for _, m := range moves {
+		err := os.MkdirAll(filepath.Dir(m.to), 0755)
+		if err == nil {
+			err = os.Rename(m.from, m.to)
+		}
+		if err != nil {
+			moveErr = errors.New(fmt.Sprintf("Moved %d of %d bills, then: %v", done, len(moves), err))
+			break
+		}
+		removeEmptyDirs(filepath.Dir(m.from), c.BillsFolder)
+		done++
+	}
+
+	for _, path := range paths {
+		newPath := movedPath(path, moves[:done])
+		content, err := ioutil.ReadFile(newPath)
+		if err != nil {
+			return err
+		}
+		if text, count := moveDocumentPaths(string(content), path, newPath, moves[:done]); count > 0 {
+			if err = writeFileAtomic(newPath, []byte(text)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.updateIncludesBeancountFile(); err != nil {
+		return err
+	}
+
+	return moveErr
+}
+
+// uses globals: config
+func actionReorganise(c *cli.Context) error {
+	moves, errs := config.planReorganise()
+
+	for _, err := range errs {
+		fmt.Printf("Skipped: %v\n", err)
+	}
+	for _, m := range moves {
+		fmt.Printf("%s\n  -> %s\n", m.from, m.to)
+	}
+
+	if len(moves) == 0 {
+		fmt.Println("Every bill is in its folder.")
+		return nil
+	}
+
+	if !c.Bool("apply") {
+		fmt.Printf("%d bills to move, run with --apply to move them.\n", len(moves))
+		return nil
+	}
+
+	if err := config.reorganise(moves); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Moved %d bills.\n", len(moves))
+
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+func TestMoveDocumentPaths(t *testing.T) {
+	moves := []billMove{
+		billMove{from: "bills/2016/02/a", to: "bills/IKEA/a"},
+		billMove{from: "bills/2016/02/b", to: "bills/CarTek/b"},
+	}
+	text := `2016-02-12 document Assets:Cash "receipt.pdf"
+2016-02-12 document Assets:Cash "../b/invoice.pdf"
+2016-02-12 document Assets:Cash "../../shared/card.pdf"
+2016-02-12 document Assets:Cash "/home/me/x.pdf"
+`
+	expect := `2016-02-12 document Assets:Cash "receipt.pdf"
+2016-02-12 document Assets:Cash "../../CarTek/b/invoice.pdf"
+2016-02-12 document Assets:Cash "../../2016/shared/card.pdf"
+2016-02-12 document Assets:Cash "/home/me/x.pdf"
+`
+
+	res, count := moveDocumentPaths(text, "bills/2016/02/a/bill.beancount", "bills/IKEA/a/bill.beancount", moves)
+	if res != expect || count != 2 {
+		t.Errorf("hey: %d\n%s", count, res)
+	}
+
+	// a ledger file reached through an absolute include
+	main, _ := filepath.Abs("main.beancount")
+	res, count = moveDocumentPaths(`2016-02-12 document Assets:Cash "bills/2016/02/b/invoice.pdf"`, main, main, moves)
+	if res != `2016-02-12 document Assets:Cash "bills/CarTek/b/invoice.pdf"` || count != 1 {
+		t.Errorf("hey: %d %s", count, res)
+	}
+}
+
+func TestReorganise(t *testing.T) {
+	bills := []Bill{
+		Bill{Transactions: []Transaction{Transaction{
+			Date:      isodate("2016-02-12"),
+			Payee:     "IKEA",
+			Narration: "cupboard",
+			Postings: []Posting{
+				Posting{Account: "Expenses:Home", Amount: dec("55.95"), Currency: "USD"},
+				Posting{Account: "Assets:Cash"},
+			},
+		}}},
+		Bill{Transactions: []Transaction{Transaction{
+			Date:      isodate("2016-03-25"),
+			Payee:     "IKEA",
+			Narration: "cupboard",
+			Postings: []Posting{
+				Posting{Account: "Expenses:Home", Amount: dec("55.95"), Currency: "USD"},
+				Posting{Account: "Assets:Cash"},
+			},
+		}}},
+		Bill{Notes: []Note{Note{Date: isodate("2016-03-25"), Account: "Assets:Cash", Description: "counted"}}},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.MainBeancountFile = "./testbills/main.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	for i := range bills {
+		if err := bills[i].Save(config); err != nil {
+			t.Fatalf("hey: %v", err)
+		}
+	}
+	// the first bill is included directly as well
+	ioutil.WriteFile(config.MainBeancountFile, []byte("include \"includes.beancount\"\ninclude \"2016/02/*/bill.beancount\"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(bills[0].DirPath, "receipt.pdf"), []byte("pdf"), 0644)
+	billPath := filepath.Join(bills[0].DirPath, bills[0].BeancountFilename())
+	f, _ := os.OpenFile(billPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("\n\n2016-02-12 document Assets:Cash \"receipt.pdf\"\n2016-02-12 document Assets:Cash \"../../03/2016-03-25 _ note/card.pdf\"\n")
+	f.Close()
+
+	if moves, errs := config.planReorganise(); len(moves) != 0 || len(errs) != 0 {
+		t.Errorf("hey: %v %v", moves, errs)
+	}
+
+	config.BillFolderTemplate = `{{.Kind}}`
+	config.BillNameTemplate = `{{if .Payee}}{{.Payee}} _ {{.Narration}}{{else}}{{.Date}}{{end}}`
+	defer func() {
+		config.BillFolderTemplate = ""
+		config.BillNameTemplate = ""
+	}()
+
+	moves, errs := config.planReorganise()
+	if len(moves) != 3 || len(errs) != 0 {
+		t.Fatalf("hey: %v %v", moves, errs)
+	}
+	if moves[0].to != filepath.Join("testbills", "transaction", "IKEA _ cupboard") ||
+		moves[1].to != filepath.Join("testbills", "transaction", "IKEA _ cupboard _ 2") {
+		t.Errorf("hey: %v", moves)
+	}
+	if ex, _ := exists(moves[0].to); ex {
+		t.Errorf("hey: moved without applying")
+	}
+
+	if err := config.reorganise(moves); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if ex, _ := exists(filepath.Join(config.BillsFolder, "2016")); ex {
+		t.Errorf("hey: the old folders are left")
+	}
+	if ex, _ := exists(filepath.Join(moves[0].to, "receipt.pdf")); !ex {
+		t.Errorf("hey: the document was not moved")
+	}
+
+	text, _ := ioutil.ReadFile(filepath.Join(moves[0].to, bills[0].BeancountFilename()))
+	if !s.Contains(string(text), `document Assets:Cash "receipt.pdf"`) ||
+		!s.Contains(string(text), `document Assets:Cash "../../note/2016-03-25/card.pdf"`) {
+		t.Errorf("hey: %s", text)
+	}
+
+	includes, _ := ioutil.ReadFile(config.IncludesBeancountFile)
+	if !s.Contains(string(includes), `"note/2016-03-25/bill.beancount"`) {
+		t.Errorf("hey: %s", includes)
+	}
+
+	if moves, errs := config.planReorganise(); len(moves) != 0 || len(errs) != 0 {
+		t.Errorf("hey: %v %v", moves, errs)
+	}
+}
+
+func TestReorganiseFailedMove(t *testing.T) {
+	bill := Bill{Transactions: []Transaction{Transaction{
+		Date:      isodate("2016-02-12"),
+		Payee:     "IKEA",
+		Narration: "cupboard",
+		Postings: []Posting{
+			Posting{Account: "Expenses:Home", Amount: dec("55.95"), Currency: "USD"},
+			Posting{Account: "Assets:Cash"},
+		},
+	}}}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.MainBeancountFile = "./testbills/main.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	billPath := filepath.Join(bill.DirPath, bill.BeancountFilename())
+	f, _ := os.OpenFile(billPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("\n\n2016-02-12 document Assets:Cash \"../card.pdf\"\n")
+	f.Close()
+
+	// the second folder can't be made
+	ioutil.WriteFile(filepath.Join(config.BillsFolder, "blocked"), []byte("x"), 0644)
+	moves := []billMove{
+		billMove{from: bill.DirPath, to: filepath.Join(config.BillsFolder, "IKEA", "cupboard")},
+		billMove{from: filepath.Join(config.BillsFolder, "nope"), to: filepath.Join(config.BillsFolder, "blocked", "nope")},
+	}
+
+	if err := config.reorganise(moves); err == nil || !s.Contains(err.Error(), "Moved 1 of 2") {
+		t.Errorf("hey: %v", err)
+	}
+
+	text, _ := ioutil.ReadFile(filepath.Join(moves[0].to, bill.BeancountFilename()))
+	if !s.Contains(string(text), `document Assets:Cash "../../2016/02/card.pdf"`) {
+		t.Errorf("hey: %s", text)
+	}
+}
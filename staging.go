@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Uploaded documents wait in a staging area until their bill is saved. Each
+// bill draft has its own area, so that people entering bills at the same
+// time from different devices don't touch each other's uploads.
+//
+// The draft id comes from the X-Draft-Id header or the draft_id form or JSON
+// value. Without one, the browser gets a draft id in a cookie.
+
+const draftCookieName = "b2b_draft"
+
+// Areas of abandoned drafts are removed after this.
+const stagingMaxAge = 24 * time.Hour
+
+var draftIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+type stagingArea struct {
+	// held while the files of the area are changed or saved
+	mu       sync.Mutex
+	dir      string
+	lastUsed time.Time
+}
+
+type stagingRegistry struct {
+	mu    sync.Mutex
+	root  string
+	areas map[string]*stagingArea
+}
+
+var staging *stagingRegistry
+
+func newStagingRegistry() (*stagingRegistry, error) {
+	root, err := ioutil.TempDir(os.TempDir(), "bills_")
+	if err != nil {
+		return nil, err
+	}
+	return &stagingRegistry{root: root, areas: make(map[string]*stagingArea)}, nil
+}
+
+func newDraftID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// area returns the staging area of the draft, creating it when needed.
+func (reg *stagingRegistry) area(id string) (*stagingArea, error) {
+	if !draftIDRe.MatchString(id) {
+		return nil, badRequest(errors.New(fmt.Sprintf("Invalid draft id: %q", id)))
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.expire()
+
+	a, ok := reg.areas[id]
+	if !ok {
+		a = &stagingArea{dir: filepath.Join(reg.root, id)}
+		reg.areas[id] = a
+	}
+	a.lastUsed = time.Now()
+
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// expire removes the areas not used for stagingMaxAge. Areas in use are
+// skipped. Must be called with reg.mu held.
+func (reg *stagingRegistry) expire() {
+	for id, a := range reg.areas {
+		if time.Since(a.lastUsed) < stagingMaxAge {
+			continue
+		}
+		if !a.mu.TryLock() {
+			continue
+		}
+		os.RemoveAll(a.dir)
+		delete(reg.areas, id)
+		a.mu.Unlock()
+	}
+}
+
+func (reg *stagingRegistry) cleanup() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	os.RemoveAll(reg.root)
+}
+
+// clear removes the staged files. Must be called with a.mu held.
+func (a *stagingArea) clear() error {
+	if err := os.RemoveAll(a.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(a.dir, 0755)
+}
+
+// draftID finds the draft of the request. fallback is a value the handler
+// already decoded from the body, such as the draft_id of a JSON request.
+func draftID(w http.ResponseWriter, r *http.Request, fallback string) string {
+	if id := r.Header.Get("X-Draft-Id"); len(id) > 0 {
+		return id
+	}
+	if len(fallback) > 0 {
+		return fallback
+	}
+	if id := r.FormValue("draft_id"); len(id) > 0 {
+		return id
+	}
+	if c, err := r.Cookie(draftCookieName); err == nil && draftIDRe.MatchString(c.Value) {
+		return c.Value
+	}
+
+	id := newDraftID()
+	http.SetCookie(w, &http.Cookie{
+		Name:     draftCookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	s "strings"
+	"sync"
+	"testing"
+)
+
+func uploadRequest(draft string, filename string, content string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", filename)
+	fw.Write([]byte(content))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("X-Draft-Id", draft)
+	return r
+}
+
+func TestStagingPerDraft(t *testing.T) {
+	var err error
+	if staging, err = newStagingRegistry(); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	defer staging.cleanup()
+
+	drafts := []string{"laptop-draft", "phone-draft"}
+
+	// both upload a file of the same name at the same time
+	var wg sync.WaitGroup
+	for _, draft := range drafts {
+		wg.Add(1)
+		go func(draft string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			uploadHandler(w, uploadRequest(draft, "receipt.pdf", draft))
+			if w.Code != http.StatusOK {
+				t.Errorf("hey: %d %s", w.Code, w.Body)
+			}
+		}(draft)
+	}
+	wg.Wait()
+
+	// the laptop removes its upload
+	form := url.Values{"filename": {"receipt.pdf"}}
+	r := httptest.NewRequest("POST", "/remove-from-tempdir", s.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Draft-Id", "laptop-draft")
+	w := httptest.NewRecorder()
+	removeFromTempdir(w, r)
+
+	// and again
+	r = httptest.NewRequest("POST", "/remove-from-tempdir", s.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Draft-Id", "laptop-draft")
+	w = httptest.NewRecorder()
+	removeFromTempdir(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("hey: %d", w.Code)
+	}
+
+	laptop, _ := staging.area("laptop-draft")
+	phone, _ := staging.area("phone-draft")
+
+	if ex, _ := exists(filepath.Join(laptop.dir, "receipt.pdf")); ex {
+		t.Errorf("hey: laptop upload was not removed")
+	}
+	if ex, _ := exists(filepath.Join(phone.dir, "receipt.pdf")); !ex {
+		t.Errorf("hey: phone upload was removed")
+	}
+
+	if _, err = staging.area("../../etc"); err == nil {
+		t.Errorf("hey: invalid draft id was accepted")
+	}
+}
+
+func TestDraftIDCookie(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/new-tempdir", nil)
+	id := draftID(w, r, "")
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != id {
+		t.Fatalf("hey: %v", cookies)
+	}
+
+	r = httptest.NewRequest("POST", "/new-tempdir", nil)
+	r.AddCookie(cookies[0])
+	if res := draftID(httptest.NewRecorder(), r, ""); res != id {
+		t.Errorf("hey: %s != %s", res, id)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	s "strings"
+)
+
+// Tags and links are counted and renamed in the bills. Merging is renaming
+// several into one, a transaction having both keeps one.
+
+type tagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// tagUsage counts the transactions of each tag and link in the bills, most
+// used first.
+func (c conf) tagUsage() (tags []tagCount, links []tagCount) {
+	tagCounts := make(map[string]int)
+	linkCounts := make(map[string]int)
+
+	for _, path := range c.billFilePaths() {
+		ledger, err := ParseBeancountFile(path)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		for _, txn := range ledger.Transactions {
+			for _, tag := range UniqStr(txn.Tags) {
+				tagCounts[tag]++
+			}
+			for _, link := range UniqStr(txn.Links) {
+				linkCounts[link]++
+			}
+		}
+	}
+
+	sorted := func(counts map[string]int) []tagCount {
+		list := []tagCount{}
+		for name, count := range counts {
+			list = append(list, tagCount{Name: name, Count: count})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Count != list[j].Count {
+				return list[i].Count > list[j].Count
+			}
+			return list[i].Name < list[j].Name
+		})
+		return list
+	}
+
+	return sorted(tagCounts), sorted(linkCounts)
+}
+
+var tagNameRe = regexp.MustCompile(`^[#^][\p{L}\p{N}_/.-]+$`)
+
+// tagName adds the # of a tag given without it, links need their ^.
+func tagName(name string) (string, error) {
+	name = s.TrimSpace(name)
+	if !s.HasPrefix(name, "#") && !s.HasPrefix(name, "^") {
+		name = "#" + name
+	}
+	if !tagNameRe.MatchString(name) {
+		return name, badRequest(errors.New(fmt.Sprintf("Not a tag or link: %q", name)))
+	}
+	return name, nil
+}
+
+// renameTags renames the tags or links in from to the one in to, in every
+// bill. With dryRun the files are not written.
+func (c conf) renameTags(from []string, to string, dryRun bool) ([]renamedFile, error) {
+	var files []renamedFile
+
+	to, err := tagName(to)
+	if err != nil {
+		return files, err
+	}
+
+	renames := make(map[string]bool)
+	for _, name := range from {
+		if name, err = tagName(name); err != nil {
+			return files, err
+		}
+		if name[0] != to[0] {
+			return files, badRequest(errors.New(fmt.Sprintf("Can't rename the tag or link %s to %s", name, to)))
+		}
+		if name != to {
+			renames[name] = true
+		}
+	}
+	if len(renames) == 0 {
+		return files, badRequest(errors.New("Nothing to rename"))
+	}
+
+	for _, path := range c.billFilePaths() {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return files, err
+		}
+		text, count := rewriteWords(string(content), func(word string) (string, bool) {
+			return to, renames[word]
+		})
+		if count > 0 {
+			files = append(files, renamedFile{path: path, oldText: string(content), newText: text, count: count})
+		}
+	}
+
+	if len(files) == 0 {
+		var names []string
+		for name := range renames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return files, badRequest(errors.New(fmt.Sprintf("Not used in any bill: %s", s.Join(names, " "))))
+	}
+
+	if dryRun {
+		return files, nil
+	}
+
+	for i, f := range files {
+		if err := writeFileAtomic(f.path, []byte(f.newText)); err != nil {
+			return files[:i], errors.New(fmt.Sprintf("Renamed in %d of %d bills, then: %v", i, len(files), err))
+		}
+	}
+
+	return files, c.updateIncludesBeancountFile()
+}
+
+// Uses globals: config
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["tags"], data["links"] = config.tagUsage()
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+type renameTagsRequest struct {
+	// one to rename, more to merge
+	From   []string `json:"from"`
+	To     string   `json:"to"`
+	DryRun bool     `json:"dry_run"`
+}
+
+// Uses globals: config
+func renameTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var req renameTagsRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
+
+	files, err := config.renameTags(req.From, req.To, req.DryRun)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	paths := []string{}
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+
+	data := make(map[string]interface{})
+	if req.DryRun {
+		data["flash"] = fmt.Sprintf("Would change %d bills", len(files))
+	} else {
+		data["flash"] = fmt.Sprintf("Changed %d bills", len(files))
+	}
+	data["paths"] = paths
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+var tagsCommands = []cli.Command{
+	{
+		Name:   "list",
+		Usage:  "list the tags and links with how many transactions have them",
+		Action: actionTagsList,
+	},
+	{
+		Name:      "rename",
+		Usage:     "rename a tag or link in every bill",
+		ArgsUsage: "OLD NEW",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "dry-run", Usage: "print the changes instead of writing them"},
+		},
+		Action: actionTagsRename,
+	},
+	{
+		Name:      "merge",
+		Usage:     "rename several tags or links to one in every bill",
+		ArgsUsage: "INTO FROM...",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "dry-run", Usage: "print the changes instead of writing them"},
+		},
+		Action: actionTagsMerge,
+	},
+}
+
+// uses globals: config
+func actionTagsList(c *cli.Context) error {
+	tags, links := config.tagUsage()
+	for _, t := range append(tags, links...) {
+		fmt.Printf("%6d %s\n", t.Count, t.Name)
+	}
+	return nil
+}
+
+// uses globals: config
+func actionTagsRename(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Usage: tags rename [--dry-run] OLD NEW", 1)
+	}
+	return printRenamedTags(c, []string{c.Args().Get(0)}, c.Args().Get(1))
+}
+
+// uses globals: config
+func actionTagsMerge(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return cli.NewExitError("Usage: tags merge [--dry-run] INTO FROM...", 1)
+	}
+	return printRenamedTags(c, c.Args().Tail(), c.Args().First())
+}
+
+// uses globals: config
+func printRenamedTags(c *cli.Context, from []string, to string) error {
+	files, err := config.renameTags(from, to, c.Bool("dry-run"))
+	if c.Bool("dry-run") {
+		for _, f := range files {
+			f.diff(os.Stdout)
+		}
+	} else {
+		for _, f := range files {
+			fmt.Printf("Renamed %d times: %s\n", f.count, f.path)
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	s "strings"
+	"testing"
+)
+
+func TestRenameTags(t *testing.T) {
+	bills := []Bill{
+		Bill{Transactions: []Transaction{Transaction{
+			Date:      isodate("2016-02-12"),
+			Payee:     "Cafe Jao",
+			Narration: "#cafe is not a tag here",
+			Tags:      []string{"#cafe", "#coffee"},
+			Links:     []string{"^trip"},
+			Postings: []Posting{
+				Posting{Account: "Expenses:Coffee", Amount: dec("5.50"), Currency: "EUR"},
+				Posting{Account: "Assets:Cash"},
+			},
+		}}},
+		Bill{Transactions: []Transaction{Transaction{
+			Date:      isodate("2016-02-13"),
+			Payee:     "Cafe Jao",
+			Narration: "coffee",
+			Tags:      []string{"#Coffee"},
+			Postings: []Posting{
+				Posting{Account: "Expenses:Coffee", Amount: dec("4.50"), Currency: "EUR"},
+				Posting{Account: "Assets:Cash"},
+			},
+		}}},
+	}
+
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	defer os.RemoveAll(config.BillsFolder)
+
+	for i := range bills {
+		if err := bills[i].Save(config); err != nil {
+			t.Fatalf("hey: %v", err)
+		}
+	}
+
+	tags, links := config.tagUsage()
+	if len(tags) != 3 || tags[0].Count != 1 || len(links) != 1 || links[0].Name != "^trip" {
+		t.Errorf("hey: %v %v", tags, links)
+	}
+
+	if _, err := config.renameTags([]string{"^trip"}, "#trip", false); err == nil {
+		t.Errorf("hey: renamed a link to a tag")
+	}
+	if _, err := config.renameTags([]string{"#tea"}, "#coffee", false); err == nil {
+		t.Errorf("hey: renamed an unused tag")
+	}
+
+	files, err := config.renameTags([]string{"cafe", "#Coffee"}, "coffee", true)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("hey: %v %v", files, err)
+	}
+	if tags, _ = config.tagUsage(); len(tags) != 3 {
+		t.Errorf("hey: written in a dry run: %v", tags)
+	}
+
+	if _, err = config.renameTags([]string{"cafe", "#Coffee"}, "coffee", false); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	tags, _ = config.tagUsage()
+	if len(tags) != 1 || tags[0].Name != "#coffee" || tags[0].Count != 2 {
+		t.Errorf("hey: %v", tags)
+	}
+
+	text, _ := ioutil.ReadFile(filepath.Join(bills[0].DirPath, bills[0].BeancountFilename()))
+	expect := `"#cafe is not a tag here" #coffee ^trip` + "\n"
+	if !s.Contains(string(text), expect) {
+		t.Errorf("hey: %s", text)
+	}
+}
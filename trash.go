@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	s "strings"
+	"time"
+)
+
+// Deleted bills are moved to TrashFolder/<deleted at>/<path in bills folder>,
+// so that they can be restored to where they were. The trash id is the path
+// inside the trash folder.
+
+const trashTimeFormat = "20060102-150405.000"
+
+type trashEntry struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DirPath   string    `json:"dir_path"`
+}
+
+// isInside reports whether path is dir or inside it.
+func isInside(path string, dir string) bool {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	return absPath == absDir || s.HasPrefix(absPath, absDir+string(filepath.Separator))
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if f.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target, f.Mode())
+	})
+}
+
+// moveDir renames src to dst. When that fails, such as across file systems,
+// it copies and only removes src once the copy is complete.
+func moveDir(src string, dst string) error {
+	if ex, _ := exists(dst); ex {
+		return conflict(errors.New(fmt.Sprintf("Already exists: %s", dst)))
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	if cerr := copyDir(src, dst); cerr != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+
+	return os.RemoveAll(src)
+}
+
+// trashBill moves a bill folder to the trash and returns its trash id.
+func (c conf) trashBill(dirPath string) (string, error) {
+	var err error
+
+	if isInside(c.TrashFolder, c.BillsFolder) {
+		return "", errors.New(fmt.Sprintf("The trash folder must be outside the bills folder: %s", c.TrashFolder))
+	}
+
+	dirPath, unlock, err := c.lockedBillDirPath(dirPath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	rel, err := filepath.Rel(c.BillsFolder, dirPath)
+	if err != nil {
+		return "", err
+	}
+
+	id := filepath.Join(time.Now().Format(trashTimeFormat), rel)
+
+	if err = moveDir(dirPath, filepath.Join(c.TrashFolder, id)); err != nil {
+		return "", err
+	}
+
+	removeEmptyDirs(filepath.Dir(dirPath), c.BillsFolder)
+
+	if err = c.updateIncludesBeancountFile(); err != nil {
+		return id, err
+	}
+
+	return id, nil
+}
+
+// trashDirPath checks that a trash id sent by a client is a deleted bill.
+func (c conf) trashDirPath(id string) (string, error) {
+	notTrash := badRequest(errors.New(fmt.Sprintf("Not in the trash: %s", id)))
+
+	id = filepath.Clean(id)
+	if len(id) == 0 || id == "." || filepath.IsAbs(id) || id == ".." || s.HasPrefix(id, ".."+string(filepath.Separator)) {
+		return "", notTrash
+	}
+
+	dirPath := filepath.Join(c.TrashFolder, id)
+	if ex, _ := exists(filepath.Join(dirPath, Bill{}.BeancountFilename())); !ex {
+		return "", notTrash
+	}
+
+	return dirPath, nil
+}
+
+// restoreBill moves a deleted bill back to where it was and returns its folder.
+func (c conf) restoreBill(id string) (string, error) {
+	trashPath, err := c.trashDirPath(id)
+	if err != nil {
+		return "", err
+	}
+
+	// drop the <deleted at> part
+	rel := s.SplitN(filepath.ToSlash(filepath.Clean(id)), "/", 2)
+	if len(rel) != 2 {
+		return "", badRequest(errors.New(fmt.Sprintf("Not in the trash: %s", id)))
+	}
+	dirPath := filepath.Join(c.BillsFolder, filepath.FromSlash(rel[1]))
+
+	if err = moveDir(trashPath, dirPath); err != nil {
+		return "", err
+	}
+
+	removeEmptyDirs(filepath.Dir(trashPath), c.TrashFolder)
+
+	if err = c.updateIncludesBeancountFile(); err != nil {
+		return dirPath, err
+	}
+
+	return dirPath, nil
+}
+
+// listTrash lists the deleted bills, the most recently deleted first.
+func (c conf) listTrash() ([]trashEntry, error) {
+	entries := []trashEntry{}
+
+	if ex, _ := exists(c.TrashFolder); !ex {
+		return entries, nil
+	}
+
+	err := filepath.Walk(c.TrashFolder, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() || f.Name() != (Bill{}).BeancountFilename() {
+			return nil
+		}
+
+		id, err := filepath.Rel(c.TrashFolder, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		parts := s.SplitN(filepath.ToSlash(id), "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		deletedAt, err := time.ParseInLocation(trashTimeFormat, parts[0], time.Local)
+		if err != nil {
+			return nil
+		}
+
+		entries = append(entries, trashEntry{
+			ID:        id,
+			DeletedAt: deletedAt,
+			DirPath:   filepath.Join(c.BillsFolder, filepath.FromSlash(parts[1])),
+		})
+		return nil
+	})
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+
+	return entries, err
+}
+
+// Uses globals: config
+func deleteBillHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if err = r.ParseForm(); err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
+
+	id, err := config.trashBill(r.PostFormValue("dir_path"))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["flash"] = "Moved to the trash"
+	data["trash_id"] = id
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+// Uses globals: config
+func restoreBillHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if err = r.ParseForm(); err != nil {
+		sendError(w, badRequest(err))
+		return
+	}
+
+	dirPath, err := config.restoreBill(r.PostFormValue("trash_id"))
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["flash"] = "Restored"
+	data["dir_path"] = dirPath
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+// Uses globals: config
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := config.listTrash()
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["trash"] = entries
+
+	w.Header().Set("Content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(data)
+}
+
+// uses globals: config
+func actionDelete(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: delete BILL_FOLDER", 1)
+	}
+
+	id, err := config.trashBill(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Printf("Moved to the trash: %s\n", id)
+	fmt.Printf("Restore with: restore %q\n", id)
+
+	return nil
+}
+
+// uses globals: config
+func actionRestore(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Usage: restore TRASH_ID", 1)
+	}
+
+	dirPath, err := config.restoreBill(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	fmt.Printf("Restored: %s\n", dirPath)
+
+	return nil
+}
+
+// uses globals: config
+func actionTrash(c *cli.Context) error {
+	entries, err := config.listTrash()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\n", e.DeletedAt.Format("2006-01-02 15:04:05"), e.ID)
+	}
+
+	return nil
+}
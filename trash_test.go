@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrashAndRestore(t *testing.T) {
+	config.BillsFolder = "./testbills"
+	config.IncludesBeancountFile = "./testbills/includes.beancount"
+	config.TrashFolder = "./testtrash"
+	defer os.RemoveAll(config.BillsFolder)
+	defer os.RemoveAll(config.TrashFolder)
+
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date:      isodate("2016-02-12"),
+				Narration: "coffee",
+				Postings: []Posting{
+					Posting{Account: "Assets:Bank:Checking", Amount: dec("-5.50"), Currency: "EUR"},
+					Posting{Account: "Expenses:Coffee"},
+				},
+			},
+		},
+		Documents: []Document{Document{Filename: "bill-one.png"}},
+	}
+
+	bill.StagingDir = "./testdata"
+	if err := bill.Save(config); err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if _, err := config.trashBill("./testdata"); err == nil {
+		t.Errorf("hey: testdata is not a bill folder")
+	}
+
+	id, err := config.trashBill(bill.DirPath)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+
+	if ex, _ := exists(bill.DirPath); ex {
+		t.Errorf("hey: still there: %s", bill.DirPath)
+	}
+	if ex, _ := exists(filepath.Join(config.TrashFolder, id, "bill-one.png")); !ex {
+		t.Errorf("hey: not in the trash: %s", id)
+	}
+	if len(config.billFilePaths()) != 0 {
+		t.Errorf("hey: %v", config.billFilePaths())
+	}
+
+	entries, err := config.listTrash()
+	if err != nil || len(entries) != 1 || entries[0].ID != id || entries[0].DirPath != bill.DirPath {
+		t.Fatalf("hey: %v %v", entries, err)
+	}
+
+	if _, err = config.restoreBill("../testdata"); err == nil {
+		t.Errorf("hey: testdata is not in the trash")
+	}
+
+	dirPath, err := config.restoreBill(id)
+	if err != nil {
+		t.Fatalf("hey: %v", err)
+	}
+	if dirPath != bill.DirPath {
+		t.Errorf("hey: %s", dirPath)
+	}
+	if ex, _ := exists(filepath.Join(dirPath, "bill-one.png")); !ex {
+		t.Errorf("hey: not restored: %s", dirPath)
+	}
+	if entries, _ = config.listTrash(); len(entries) != 0 {
+		t.Errorf("hey: %v", entries)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"path/filepath"
+	"regexp"
+	s "strings"
+	"time"
+)
+
+// Bills are checked against the main beancount file before they are saved,
+// so that mistakes bean-check would find later are reported on the form:
+// transactions which don't balance, accounts which are not open on the date
+// and currencies which are not declared.
+
+type fieldError struct {
+	// such as transactions[0].postings[1].amount
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError is answered with 422 and the fields.
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e validationError) Error() string {
+	var msgs []string
+	for _, f := range e.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return s.Join(msgs, "; ")
+}
+
+// prefixFields puts the path of the parent in front of the fields.
+func prefixFields(prefix string, errs []fieldError) []fieldError {
+	var out []fieldError
+	for _, e := range errs {
+		out = append(out, fieldError{Field: prefix + "." + e.Field, Message: e.Message})
+	}
+	return out
+}
+
+// ledgerIndex has the accounts and currencies a bill can use.
+type ledgerIndex struct {
+	opens      map[string]Open
+	closes     map[string]time.Time
+	currencies map[string]bool
+	// without a main beancount file only missing accounts and currencies
+	// are reported
+	noLedger bool
+}
+
+// walkLedgerFiles calls fn with each of the main beancount file and the files
+// it includes, except the includes file of the bills, which only has bills.
+func (c conf) walkLedgerFiles(fn func(path string, ledger Ledger)) error {
+	skip := make(map[string]bool)
+	if abs, err := filepath.Abs(c.IncludesBeancountFile); err == nil {
+		skip[abs] = true
+	}
+
+	var read func(path string, main bool) error
+	read = func(path string, main bool) error {
+		abs, err := filepath.Abs(path)
+		if err != nil || skip[abs] {
+			return err
+		}
+		skip[abs] = true
+
+		ledger, err := ParseBeancountFile(path)
+		if err != nil {
+			if _, ok := err.(ParseErrors); !ok {
+				if main {
+					return err
+				}
+				log.Printf("%v", err)
+				return nil
+			}
+			log.Printf("%v", err)
+		}
+
+		fn(path, ledger)
+
+		for _, inc := range ledger.Includes {
+			pattern := inc.Path
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			paths, _ := filepath.Glob(pattern)
+			for _, p := range paths {
+				if err := read(p, false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return read(c.MainBeancountFile, true)
+}
+
+// loadLedgerIndex reads the accounts and currencies of the main beancount
+// file and the files it includes.
+func (c conf) loadLedgerIndex() (ledgerIndex, error) {
+	idx := ledgerIndex{
+		opens:      make(map[string]Open),
+		closes:     make(map[string]time.Time),
+		currencies: make(map[string]bool),
+	}
+
+	err := c.walkLedgerFiles(func(path string, ledger Ledger) {
+		for _, open := range ledger.Opens {
+			idx.opens[open.Account] = open
+			for _, cur := range open.Currencies {
+				idx.currencies[cur] = true
+			}
+		}
+		for _, cl := range ledger.Closes {
+			idx.closes[cl.Account] = cl.Date
+		}
+		for _, com := range ledger.Commodities {
+			idx.currencies[com.Currency] = true
+		}
+		for _, opt := range ledger.Options {
+			if opt.Name == "operating_currency" {
+				idx.currencies[opt.Value] = true
+			}
+		}
+	})
+
+	return idx, err
+}
+
+// checkAccount returns why the account can't be used on the date, or "".
+func (idx ledgerIndex) checkAccount(account string, date time.Time) string {
+	if len(account) == 0 {
+		return "Account is missing"
+	}
+	if idx.noLedger {
+		return ""
+	}
+	open, ok := idx.opens[account]
+	if !ok {
+		return fmt.Sprintf("Account %s is not open", account)
+	}
+	if date.Before(open.Date) {
+		return fmt.Sprintf("Account %s is opened on %s", account, open.Date.Format("2006-01-02"))
+	}
+	if closed, ok := idx.closes[account]; ok && !date.Before(closed) {
+		return fmt.Sprintf("Account %s is closed on %s", account, closed.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// checkCurrency returns why the currency can't be used in the account, or "".
+func (idx ledgerIndex) checkCurrency(currency string, account string) string {
+	if len(currency) == 0 {
+		return "Currency is missing"
+	}
+	if idx.noLedger {
+		return ""
+	}
+	if !idx.currencies[currency] {
+		return fmt.Sprintf("Currency %s is not declared", currency)
+	}
+	if open, ok := idx.opens[account]; ok && len(open.Currencies) > 0 {
+		for _, cur := range open.Currencies {
+			if cur == currency {
+				return ""
+			}
+		}
+		return fmt.Sprintf("Account %s doesn't hold %s", account, currency)
+	}
+	return ""
+}
+
+var (
+	// {10.00 USD}, {{100.00 USD}} and {10.00 USD, 2016-01-01, "lot"}
+	costRe = regexp.MustCompile(`^(\{\{?)\s*([-+0-9.]+)\s+([A-Z][A-Z0-9'._-]*)\s*(?:,[^}]*)?\}\}?$`)
+	// @ 1.10 USD and @@ 110.00 USD
+	priceRe = regexp.MustCompile(`^(@@?)\s*([-+0-9.]+)\s+([A-Z][A-Z0-9'._-]*)$`)
+)
+
+// postingWeight is the amount a posting adds to the balance of its
+// transaction, with the decimal places it was written with.
+type postingWeight struct {
+	amount   Decimal
+	currency string
+	scale    int
+}
+
+// weight is the cost of units held at cost, the converted amount of a price,
+// or else the amount. ok is false when it can't be worked out, such as for an
+// empty cost {} left to beancount.
+func (p Posting) weight() (w postingWeight, ok bool) {
+	convert := func(m []string, total bool) (postingWeight, bool) {
+		n, err := ParseDecimal(m[2])
+		if err != nil {
+			return w, false
+		}
+		w = postingWeight{amount: p.Amount.Mul(n), currency: m[3], scale: n.Scale()}
+		if total {
+			w.amount = n.Abs()
+			if p.Amount.Sign() < 0 {
+				w.amount = w.amount.Neg()
+			}
+		}
+		return w, true
+	}
+
+	if len(p.Cost) > 0 {
+		m := costRe.FindStringSubmatch(s.TrimSpace(p.Cost))
+		if m == nil {
+			return w, false
+		}
+		return convert(m, m[1] == "{{")
+	}
+	if len(p.Price) > 0 {
+		m := priceRe.FindStringSubmatch(s.TrimSpace(p.Price))
+		if m == nil {
+			return w, false
+		}
+		return convert(m, m[1] == "@@")
+	}
+	return postingWeight{amount: p.Amount, currency: p.Currency, scale: p.Amount.Scale()}, true
+}
+
+// elided is a posting without an amount, which beancount fills in. A zero
+// amount is not written, the web app sends one with the currency selected.
+func (p Posting) elided() bool {
+	return p.Amount.IsZero() && len(p.Cost) == 0 && len(p.Price) == 0
+}
+
+// tolerance is half a unit of the last decimal place, as in beancount.
+func tolerance(scale int) Decimal {
+	return Decimal{coef: big.NewInt(5), scale: scale + 1}
+}
+
+// checkBalanced returns the field errors of a transaction which doesn't sum
+// to zero per currency. One posting may leave its amount out.
+func (t Transaction) checkBalanced(field string) []fieldError {
+	var errs []fieldError
+
+	sums := make(map[string]Decimal)
+	// the fewest decimal places per currency
+	scales := make(map[string]int)
+	var currencies []string
+	elided := 0
+
+	for i, p := range t.Postings {
+		if p.elided() {
+			elided++
+			if elided > 1 {
+				errs = append(errs, fieldError{
+					Field:   fmt.Sprintf("%s.postings[%d].amount", field, i),
+					Message: "Only one posting can leave out the amount",
+				})
+			}
+			continue
+		}
+		w, ok := p.weight()
+		if !ok {
+			// left for beancount to work out
+			return errs
+		}
+		if len(w.currency) == 0 {
+			// reported as a missing currency
+			continue
+		}
+		if _, seen := sums[w.currency]; !seen {
+			currencies = append(currencies, w.currency)
+			scales[w.currency] = w.scale
+		}
+		if w.scale < scales[w.currency] {
+			scales[w.currency] = w.scale
+		}
+		sums[w.currency] = sums[w.currency].Add(w.amount)
+	}
+
+	if elided > 0 {
+		return errs
+	}
+
+	for _, cur := range currencies {
+		if sums[cur].Abs().Cmp(tolerance(scales[cur])) > 0 {
+			errs = append(errs, fieldError{
+				Field:   field + ".postings",
+				Message: fmt.Sprintf("The postings don't balance, %s %s is left over", sums[cur].String(), cur),
+			})
+		}
+	}
+
+	return errs
+}
+
+// validate returns the field errors of the bill, with the field paths of the
+// JSON it came from.
+func (idx ledgerIndex) validate(b Bill) []fieldError {
+	errs := []fieldError{}
+
+	add := func(field string, msg string) {
+		if len(msg) > 0 {
+			errs = append(errs, fieldError{Field: field, Message: msg})
+		}
+	}
+
+	for i, txn := range b.Transactions {
+		field := fmt.Sprintf("transactions[%d]", i)
+
+		if len(txn.Postings) == 0 {
+			add(field+".postings", "A transaction needs postings")
+		}
+
+		for j, p := range txn.Postings {
+			pfield := fmt.Sprintf("%s.postings[%d]", field, j)
+			add(pfield+".account", idx.checkAccount(p.Account, txn.Date))
+			if !p.elided() {
+				add(pfield+".currency", idx.checkCurrency(p.Currency, p.Account))
+			}
+		}
+
+		errs = append(errs, txn.checkBalanced(field)...)
+	}
+
+	for i, bal := range b.Balances {
+		field := fmt.Sprintf("balances[%d]", i)
+		add(field+".source_account", idx.checkAccount(bal.SourceAccount, bal.Date))
+		add(field+".currency", idx.checkCurrency(bal.Currency, bal.SourceAccount))
+		if bal.Padded {
+			add(field+".target_account", idx.checkAccount(bal.TargetAccount, bal.Date))
+		}
+	}
+
+	for i, note := range b.Notes {
+		add(fmt.Sprintf("notes[%d].account", i), idx.checkAccount(note.Account, note.Date))
+	}
+
+	// documents without an account get one of the bill's
+	for i, doc := range b.Documents {
+		if len(doc.Account) > 0 && !doc.Date.IsZero() {
+			add(fmt.Sprintf("documents[%d].account", i), idx.checkAccount(doc.Account, doc.Date))
+		}
+	}
+
+	return errs
+}
+
+// checkIndex is what bills are checked against, the accounts and currencies
+// of the main beancount file when there is one.
+func (c conf) checkIndex() (ledgerIndex, error) {
+	if ex, _ := exists(c.MainBeancountFile); !ex {
+		return ledgerIndex{noLedger: true}, nil
+	}
+	return c.loadLedgerIndex()
+}
+
+// checkBill returns a validationError when the bill would not pass bean-check.
+// Without a main beancount file there are no accounts to check against, only
+// the bill itself is checked.
+func (c conf) checkBill(b Bill) error {
+	idx, err := c.checkIndex()
+	if err != nil {
+		return err
+	}
+	if errs := idx.validate(b); len(errs) > 0 {
+		return validationError{Fields: errs}
+	}
+	return nil
+}
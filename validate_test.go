@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testMainBeancount = `option "operating_currency" "EUR"
+include "accounts.beancount"
+include "includes.beancount"
+
+2016-01-01 commodity USD
+`
+
+var testAccountsBeancount = `2016-01-01 open Assets:Bank:Checking EUR
+2016-01-01 open Assets:Cash
+2016-01-01 open Expenses:Coffee
+2016-02-01 open Expenses:Travel
+2016-01-01 open Expenses:Old
+2016-02-01 close Expenses:Old
+`
+
+func TestTransactionCheckBalanced(t *testing.T) {
+	txn := Transaction{
+		Postings: []Posting{
+			Posting{Account: "Expenses:Coffee", Amount: dec("5.50"), Currency: "EUR"},
+			Posting{Account: "Assets:Cash", Amount: dec("-5.50"), Currency: "EUR"},
+		},
+	}
+	if errs := txn.checkBalanced("transactions[0]"); len(errs) != 0 {
+		t.Errorf("hey: %v", errs)
+	}
+
+	txn.Postings[1].Amount = dec("-5.00")
+	errs := txn.checkBalanced("transactions[0]")
+	if len(errs) != 1 || errs[0].Field != "transactions[0].postings" {
+		t.Errorf("hey: %v", errs)
+	}
+
+	// the other posting is filled in
+	txn.Postings[1] = Posting{Account: "Assets:Cash"}
+	if errs = txn.checkBalanced("transactions[0]"); len(errs) != 0 {
+		t.Errorf("hey: %v", errs)
+	}
+	txn.Postings[1] = Posting{Account: "Assets:Cash", Amount: dec("0.00"), Currency: "EUR"}
+	if errs = txn.checkBalanced("transactions[0]"); len(errs) != 0 {
+		t.Errorf("hey: %v", errs)
+	}
+
+	txn.Postings = append(txn.Postings, Posting{Account: "Assets:Bank:Checking"})
+	errs = txn.checkBalanced("transactions[0]")
+	if len(errs) != 1 || errs[0].Field != "transactions[0].postings[2].amount" {
+		t.Errorf("hey: %v", errs)
+	}
+
+	// 10 USD at 0.9123 EUR is 9.123 EUR, within the tolerance of 9.12
+	txn.Postings = []Posting{
+		Posting{Account: "Assets:Cash", Amount: dec("10"), Currency: "USD", Price: "@ 0.9123 EUR"},
+		Posting{Account: "Assets:Bank:Checking", Amount: dec("-9.12"), Currency: "EUR"},
+	}
+	if errs = txn.checkBalanced("transactions[0]"); len(errs) != 0 {
+		t.Errorf("hey: %v", errs)
+	}
+
+	txn.Postings[0].Price = "@@ 9.20 EUR"
+	if errs = txn.checkBalanced("transactions[0]"); len(errs) != 1 {
+		t.Errorf("hey: %v", errs)
+	}
+}
+
+func TestCheckBill(t *testing.T) {
+	os.MkdirAll("./testledger", 0755)
+	defer os.RemoveAll("./testledger")
+	ioutil.WriteFile("./testledger/main.beancount", []byte(testMainBeancount), 0644)
+	ioutil.WriteFile("./testledger/accounts.beancount", []byte(testAccountsBeancount), 0644)
+	// bills don't declare anything, and aren't read
+	ioutil.WriteFile("./testledger/includes.beancount", []byte("this is not beancount"), 0644)
+
+	c := conf{
+		MainBeancountFile:     "./testledger/main.beancount",
+		IncludesBeancountFile: "./testledger/includes.beancount",
+	}
+
+	bill := Bill{
+		Transactions: []Transaction{
+			Transaction{
+				Date: isodate("2016-01-12"),
+				Postings: []Posting{
+					Posting{Account: "Expenses:Coffee", Amount: dec("5.50"), Currency: "EUR"},
+					Posting{Account: "Assets:Cash"},
+				},
+			},
+		},
+		Balances: []Balance{
+			Balance{Date: isodate("2016-01-13"), SourceAccount: "Assets:Bank:Checking", Amount: dec("100"), Currency: "EUR"},
+		},
+	}
+	if err := c.checkBill(bill); err != nil {
+		t.Errorf("hey: %v", err)
+	}
+
+	bill.Transactions[0].Postings = []Posting{
+		Posting{Account: "Expenses:Travel", Amount: dec("5.50"), Currency: "GBP"},
+		Posting{Account: "Expenses:Old"},
+		Posting{Account: "Expenses:Unknown"},
+	}
+	bill.Balances[0].Currency = "USD"
+
+	err := c.checkBill(bill)
+	verr, ok := err.(validationError)
+	if !ok {
+		t.Fatalf("hey: %v", err)
+	}
+
+	expect := map[string]bool{
+		"transactions[0].postings[0].account":  true,
+		"transactions[0].postings[0].currency": true,
+		"transactions[0].postings[2].account":  true,
+		"transactions[0].postings[2].amount":   true,
+		"balances[0].currency":                 true,
+	}
+	for _, f := range verr.Fields {
+		if !expect[f.Field] {
+			t.Errorf("hey: %s: %s", f.Field, f.Message)
+		}
+		delete(expect, f.Field)
+	}
+	if len(expect) != 0 {
+		t.Errorf("hey: no errors for %v", expect)
+	}
+
+	// closed on the day
+	bill.Transactions[0].Date = isodate("2016-02-01")
+	bill.Transactions[0].Postings = []Posting{
+		Posting{Account: "Expenses:Travel", Amount: dec("5.50"), Currency: "EUR"},
+		Posting{Account: "Expenses:Old"},
+	}
+	bill.Balances = nil
+	verr, ok = c.checkBill(bill).(validationError)
+	if !ok || len(verr.Fields) != 1 || verr.Fields[0].Field != "transactions[0].postings[1].account" {
+		t.Errorf("hey: %v", verr)
+	}
+
+	// without a main beancount file only the bill itself is checked
+	c.MainBeancountFile = "./testledger/missing.beancount"
+	if err := c.checkBill(bill); err != nil {
+		t.Errorf("hey: %v", err)
+	}
+	bill.Transactions[0].Postings[0].Amount = dec("0")
+	verr, ok = c.checkBill(bill).(validationError)
+	if !ok || len(verr.Fields) != 1 || verr.Fields[0].Field != "transactions[0].postings[1].amount" {
+		t.Errorf("hey: %v", verr)
+	}
+}